@@ -7,10 +7,21 @@ require (
 	github.com/azazeal/fly v1.2.0
 	github.com/azazeal/health v1.5.0
 	github.com/azazeal/pause v1.1.0
+	github.com/prometheus/client_golang v1.14.0
+	go.uber.org/atomic v1.10.0
 	go.uber.org/zap v1.21.0
+	golang.org/x/net v0.7.0
 )
 
 require (
-	go.uber.org/atomic v1.9.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.37.0 // indirect
+	github.com/prometheus/procfs v0.8.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
+	golang.org/x/sys v0.5.0 // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
 )
@@ -0,0 +1,227 @@
+// Package acl implements the source address rules of the listening ports.
+package acl
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/azazeal/pause"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/azazeal/flycast/internal/config"
+)
+
+// resolveInterval denotes how often the host names of rules are resolved.
+const resolveInterval = 10 * time.Second
+
+// The set of rules packets may be rejected by.
+const (
+	// RuleDeny denotes the rejection of packets from denied sources.
+	RuleDeny = "deny"
+
+	// RuleAllow denotes the rejection of packets from sources which are not
+	// allowed.
+	RuleAllow = "allow"
+)
+
+// Refresh returns the Rules of the given ACL, or nil in case the ACL accepts
+// all sources. For as long as ctx is not done, the host names of the ACL are
+// periodically resolved; until they are, they match no address.
+//
+// When ctx is done and resolving has stopped, Done will be called on wg.
+func Refresh(ctx context.Context, wg *sync.WaitGroup, logger *zap.Logger, acl *config.ACL) *Rules {
+	if acl.IsZero() {
+		wg.Done()
+
+		return nil
+	}
+
+	r := &Rules{
+		allow: newMatcher(acl.Allow),
+		deny:  newMatcher(acl.Deny),
+	}
+
+	go func() {
+		defer wg.Done()
+
+		if !r.allow.hasHosts() && !r.deny.hasHosts() {
+			return // nothing to resolve
+		}
+
+		for ctx.Err() == nil {
+			r.allow.resolve(ctx, logger)
+			r.deny.resolve(ctx, logger)
+
+			pause.For(ctx, resolveInterval)
+		}
+	}()
+
+	return r
+}
+
+// Rules admits packets according to their source address.
+//
+// Rules is safe for concurrent use.
+type Rules struct {
+	allow *matcher // nil for all sources
+	deny  *matcher
+}
+
+// Admit reports whether packets from ip are admitted and, when they are not,
+// the rule which rejects them. Admit is safe to call on nil Rules, which admit
+// all sources.
+func (r *Rules) Admit(ip net.IP) (ok bool, rule string) {
+	switch {
+	case r == nil:
+		return true, ""
+	case r.deny.match(ip):
+		return false, RuleDeny
+	case r.allow != nil && !r.allow.match(ip):
+		return false, RuleAllow
+	default:
+		return true, ""
+	}
+}
+
+// matcher matches addresses against a set of sources.
+type matcher struct {
+	nets     []*net.IPNet
+	hosts    []string
+	resolved atomic.Pointer[[]net.IP] // the addresses hosts last resolved to
+	last     map[string][]net.IP      // ditto, by host; owned by resolve
+}
+
+// newMatcher returns a matcher of the given sources, or nil in case there are
+// none.
+func newMatcher(srcs []config.Source) *matcher {
+	if len(srcs) == 0 {
+		return nil
+	}
+
+	m := new(matcher)
+	for _, src := range srcs {
+		if src.Net != nil {
+			m.nets = append(m.nets, src.Net)
+		} else {
+			m.hosts = append(m.hosts, src.Host)
+		}
+	}
+
+	return m
+}
+
+// match reports whether ip belongs to any of the sources of m. match is safe
+// to call on a nil matcher, which matches nothing.
+func (m *matcher) match(ip net.IP) bool {
+	if m == nil || ip == nil {
+		return false
+	}
+
+	for _, n := range m.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	if resolved := m.resolved.Load(); resolved != nil {
+		for _, addr := range *resolved {
+			if addr.Equal(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// resolve resolves the host names of m. The addresses of host names which
+// fail resolving are retained from the previous resolution.
+func (m *matcher) resolve(ctx context.Context, logger *zap.Logger) {
+	if m == nil || len(m.hosts) == 0 {
+		return
+	}
+
+	cur := make(map[string][]net.IP, len(m.hosts))
+	var addrs []net.IP
+	for _, host := range m.hosts {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Warn("failed resolving source host.",
+					zap.String("host", host),
+					zap.Error(err))
+			}
+
+			ips = m.last[host]
+		}
+		cur[host] = ips
+		addrs = append(addrs, ips...)
+	}
+
+	m.last = cur
+	m.resolved.Store(&addrs)
+}
+
+func (m *matcher) hasHosts() bool {
+	return m != nil && len(m.hosts) > 0
+}
+
+// Registry holds the Rules of the listening ports.
+//
+// Registry is safe for concurrent use.
+type Registry struct {
+	mu    sync.Mutex
+	rules map[int]*Rules // by port
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		rules: make(map[int]*Rules),
+	}
+}
+
+// Rules returns the Rules of the given port, as Refresh does for the given
+// ACL. The Rules of a port are created, and refreshed for as long as ctx is
+// not done, on first use and shared by whatever accepts packets for the port
+// thereafter; in that case Done is called on wg right away.
+//
+// Rules is safe to call on a nil Registry, in which case the Rules it returns
+// are not shared.
+func (r *Registry) Rules(ctx context.Context, wg *sync.WaitGroup, logger *zap.Logger, port int, acl *config.ACL) *Rules {
+	if r == nil {
+		return Refresh(ctx, wg, logger, acl)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if rules, ok := r.rules[port]; ok {
+		wg.Done()
+
+		return rules
+	}
+
+	rules := Refresh(ctx, wg, logger, acl)
+	r.rules[port] = rules
+
+	return rules
+}
+
+type contextKeyType struct{}
+
+// FromContext returns the Registry the given Context carries, or nil in case
+// it carries none.
+func FromContext(ctx context.Context) *Registry {
+	r, _ := ctx.Value(contextKeyType{}).(*Registry)
+
+	return r
+}
+
+// NewContext returns a copy of ctx which carries r.
+func NewContext(ctx context.Context, r *Registry) context.Context {
+	return context.WithValue(ctx, contextKeyType{}, r)
+}
@@ -0,0 +1,55 @@
+package acl
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/azazeal/flycast/internal/config"
+)
+
+func TestRegistry(t *testing.T) {
+	_, denied, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		r      = NewRegistry()
+		logger = zap.NewNop()
+		acl    = &config.ACL{Deny: []config.Source{{Net: denied}}}
+
+		wg sync.WaitGroup
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wg.Add(3)
+	a := r.Rules(ctx, &wg, logger, 1, acl)
+	b := r.Rules(ctx, &wg, logger, 1, acl)
+	c := r.Rules(ctx, &wg, logger, 2, &config.ACL{})
+	wg.Wait() // nothing to resolve
+
+	switch {
+	case a == nil:
+		t.Fatal("a port which restricts sources has no rules")
+	case b != a:
+		t.Fatal("the rules of a port are not shared")
+	case c != nil:
+		t.Fatal("a port which accepts all sources has rules")
+	}
+
+	if ok, rule := b.Admit(net.IPv4(192, 0, 2, 1)); ok || rule != RuleDeny {
+		t.Errorf("expected the deny rule to apply, got %t and %q", ok, rule)
+	}
+
+	var nilRegistry *Registry
+	wg.Add(1)
+	if nilRegistry.Rules(ctx, &wg, logger, 1, acl) == a {
+		t.Error("a nil registry shared rules")
+	}
+	wg.Wait()
+}
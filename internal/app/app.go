@@ -13,45 +13,65 @@ import (
 	"sync"
 	"time"
 
-	"github.com/azazeal/fly/env"
 	"github.com/azazeal/health"
 	"github.com/azazeal/pause"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 
+	"github.com/azazeal/flycast/internal/auth"
 	"github.com/azazeal/flycast/internal/common"
 	"github.com/azazeal/flycast/internal/config"
 	"github.com/azazeal/flycast/internal/log"
 	"github.com/azazeal/flycast/internal/loop"
+	"github.com/azazeal/flycast/internal/peer"
+	"github.com/azazeal/flycast/internal/ratelimit"
 )
 
-// Serve starts a goroutine which serves the app server until ctx is canceled.
+// Serve starts the goroutines which serve the app server until ctx is
+// canceled.
+//
+// The index page and the health check are served on the HTTP port, which may
+// be published. Broadcasting, along with the metrics and the throttled
+// sources, is served on the private port only, which should not be.
+//
+// lists are the peer lists of the channels the app server will broadcast to
+// when requested to do so.
 //
 // When the app server has stopped being ran, Done will called on wg.
-func Serve(ctx context.Context, wg *sync.WaitGroup) {
+func Serve(ctx context.Context, wg *sync.WaitGroup, lists ...*peer.List) {
 	var (
 		logger = log.FromContext(ctx).Named("app")
 		cfg    = config.FromContext(ctx)
-		addr   = fmt.Sprintf(":%d", cfg.Ports.HTTP)
-		hc     = health.FromContext(ctx)
 	)
 
-	mux := newMux(ctx)
+	wg.Add(1)
+	go listen(ctx, wg, logger, common.HCPrivateComponent, cfg.Ports.Private, newPrivateMux(ctx, wg, lists))
 
-	go func() {
-		defer wg.Done()
+	go listen(ctx, wg, logger, common.HCAppComponent, cfg.Ports.HTTP, newMux(ctx, lists))
+}
+
+// listen serves h on the given port, which it reports the health of under the
+// given component, until ctx is canceled. Done is called on wg once it has
+// stopped.
+func listen(ctx context.Context, wg *sync.WaitGroup, logger *zap.Logger, component string, port int, h http.Handler) {
+	defer wg.Done()
 
-		loop.Func(ctx, time.Second, func(ctx context.Context) {
-			defer hc.Fail(common.HCAppComponent)
+	var (
+		addr = fmt.Sprintf(":%d", port)
+		hc   = health.FromContext(ctx)
+	)
 
-			if l := bind(logger, addr); l != nil {
-				hc.Pass(common.HCAppComponent)
+	loop.Func(ctx, time.Second, func(ctx context.Context) {
+		defer hc.Fail(component)
 
-				serve(ctx, logger, l, mux)
-			}
+		if l := bind(logger, addr); l != nil {
+			hc.Pass(component)
 
-			pause.For(ctx, time.Second)
-		})
-	}()
+			serve(ctx, logger, l, h)
+		}
+
+		pause.For(ctx, time.Second)
+	})
 }
 
 func serve(parent context.Context, logger *zap.Logger, l net.Listener, h http.Handler) {
@@ -141,19 +161,23 @@ type indexViewData struct {
 }
 
 func index(w http.ResponseWriter, r *http.Request) {
-	hc := health.FromContext(r.Context())
+	var (
+		hc  = health.FromContext(r.Context())
+		cfg = config.FromContext(r.Context())
+	)
 
 	failures := hc.Failing(nil)
 	sort.Strings(failures)
 
 	_ = indexTemplate.Execute(w, indexViewData{
 		AppName:  common.AppName,
-		Region:   env.Region(),
+		Region:   cfg.Region,
 		Failures: failures,
 	})
 }
 
-func newMux(ctx context.Context) (mux *http.ServeMux) {
+// newMux returns the handler of the HTTP port.
+func newMux(ctx context.Context, lists []*peer.List) (mux *http.ServeMux) {
 	mux = http.NewServeMux()
 
 	match := func(path string, h http.Handler, methods ...string) {
@@ -165,14 +189,32 @@ func newMux(ctx context.Context) (mux *http.ServeMux) {
 	}
 
 	hc := health.FromContext(ctx)
-	match("/health", hc, http.MethodGet, http.MethodHead)
-	// TODO: re-enable once HTTP broadcasting is implemented
-	// matchFunc("/broadcast", broadcast, http.MethodPost)
+	match("/health", healthCheck(hc, lists...), http.MethodGet, http.MethodHead)
 	matchFunc("/", index, http.MethodGet)
 
 	return
 }
 
+// newPrivateMux returns the handler of the private port.
+func newPrivateMux(ctx context.Context, wg *sync.WaitGroup, lists []*peer.List) (mux *http.ServeMux) {
+	mux = http.NewServeMux()
+
+	match := func(path string, h http.Handler, methods ...string) {
+		mux.Handle(path, restrict(h, path, methods...))
+	}
+
+	var kr *auth.Keyring
+	if config.FromContext(ctx).Auth.Ingress {
+		kr = auth.FromContext(ctx)
+	}
+
+	match("/broadcast", broadcast(ctx, wg, kr, lists...), http.MethodPost)
+	match("/throttled", throttled(ratelimit.FromContext(ctx)), http.MethodGet)
+	match("/metrics", promhttp.Handler(), http.MethodGet)
+
+	return
+}
+
 func restrict(h http.Handler, path string, methods ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch {
@@ -0,0 +1,271 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/azazeal/flycast/internal/acl"
+	"github.com/azazeal/flycast/internal/auth"
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/egress"
+	"github.com/azazeal/flycast/internal/log"
+	"github.com/azazeal/flycast/internal/metrics"
+	"github.com/azazeal/flycast/internal/peer"
+	"github.com/azazeal/flycast/internal/ratelimit"
+)
+
+// The query parameters which select the channel a broadcast request targets.
+const (
+	channelParam = "channel"
+	scopeParam   = "scope" // legacy alias of channelParam
+)
+
+type broadcastResult struct {
+	Channel string `json:"channel"`
+	Scope   string `json:"scope"`
+	Peers   int    `json:"peers"`
+	Failed  int    `json:"failed"`
+}
+
+// broadcast returns the handler which relays the body of the requests it
+// serves to the peer list of the channel the channel (or scope) query
+// parameter names, defaulting to the first of lists.
+//
+// The source rules and rate limits of the channel, which its port shares,
+// apply to the address requests arrive from, and the bodies undergo the egress
+// processing of the channel before being relayed. Unless kr is nil, bodies
+// which do not carry an ingress tag it verifies are rejected.
+//
+// When ctx is done, the socket bodies are sent via has been closed and the
+// source rules are no longer resolved, Done will be called on wg.
+func broadcast(ctx context.Context, wg *sync.WaitGroup, kr *auth.Keyring, lists ...*peer.List) http.Handler {
+	var (
+		sc    = new(sharedConn)
+		chans = make(map[*peer.List]*channel, len(lists))
+	)
+	for _, pl := range lists {
+		chans[pl] = newChannel(ctx, wg, pl.Channel())
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+		sc.close()
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := log.FromContext(r.Context()).
+			Named("app").
+			Named("broadcast")
+
+		var res broadcastResult
+
+		pl := findList(r, lists)
+		if pl == nil {
+			respondWith(w, http.StatusBadRequest)
+
+			return
+		}
+		res.Channel, res.Scope = pl.Channel().Name, pl.Channel().Scope
+
+		var (
+			ch = chans[pl]
+			ip = remoteIP(r)
+		)
+		if !ch.admit(logger, ip) {
+			respondWith(w, http.StatusForbidden)
+
+			return
+		}
+
+		msg, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(pl.Channel().MaxSize)))
+		switch {
+		case err != nil:
+			respondWith(w, http.StatusRequestEntityTooLarge)
+
+			return
+		case len(msg) == 0:
+			respondWith(w, http.StatusBadRequest)
+
+			return
+		}
+
+		if ok, limit := ch.limit.Admit(ip, len(msg)); !ok {
+			logger.Warn("throttled request.",
+				log.IP(ip),
+				zap.String("limit", limit))
+
+			respondWith(w, http.StatusTooManyRequests)
+
+			return
+		}
+
+		var ok bool
+		if msg, ok = kr.Verify(auth.TypeIngress, msg); !ok {
+			respondWith(w, http.StatusUnauthorized)
+
+			return
+		}
+
+		conn, err := sc.get()
+		if err != nil {
+			logger.Error("failed binding.",
+				zap.Error(err))
+
+			respondWith(w, http.StatusInternalServerError)
+
+			return
+		}
+
+		var filtered int
+		if res.Peers, res.Failed, filtered = ch.out.Broadcast(pl, conn, msg); filtered > 0 {
+			respondWith(w, http.StatusConflict)
+
+			return
+		}
+
+		logger.Info("broadcasted.",
+			zap.String(channelParam, res.Channel),
+			zap.Int("peers", res.Peers),
+			zap.Int("failed", res.Failed))
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+// channel wraps the processing the requests which broadcast to a channel
+// undergo.
+type channel struct {
+	out   *egress.Pipeline
+	rules *acl.Rules         // nil unless sources are restricted
+	limit *ratelimit.Limiter // nil unless rates are limited; shared with the port
+
+	denied     prometheus.Counter
+	disallowed prometheus.Counter
+}
+
+func newChannel(ctx context.Context, wg *sync.WaitGroup, ch *config.Channel) *channel {
+	var (
+		logger = log.FromContext(ctx).
+			Named("app").
+			Named("broadcast").
+			Named(ch.Name)
+		port = metrics.Port(ch.Port)
+	)
+
+	wg.Add(1)
+
+	return &channel{
+		out:        egress.New(ctx, ch),
+		rules:      acl.FromContext(ctx).Rules(ctx, wg, logger, ch.Port, &ch.ACL),
+		limit:      ratelimit.FromContext(ctx).Limiter(ch.Name, ch.Port, ch.Rate),
+		denied:     metrics.Rejected.WithLabelValues(port, acl.RuleDeny),
+		disallowed: metrics.Rejected.WithLabelValues(port, acl.RuleAllow),
+	}
+}
+
+// admit reports whether the source rules of ch admit the given address.
+// Rejections count against the port of the channel.
+func (ch *channel) admit(logger *zap.Logger, ip net.IP) bool {
+	ok, rule := ch.rules.Admit(ip)
+	if ok {
+		return true
+	}
+
+	if rule == acl.RuleDeny {
+		ch.denied.Inc()
+	} else {
+		ch.disallowed.Inc()
+	}
+
+	logger.Warn("rejected request.",
+		log.IP(ip),
+		zap.String("rule", rule))
+
+	return false
+}
+
+// remoteIP returns the IP address r arrives from, or nil in case it is
+// unknown.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// findList returns the list of the channel r selects, or nil in case r selects
+// no known channel.
+func findList(r *http.Request, lists []*peer.List) *peer.List {
+	q := r.URL.Query()
+
+	name := q.Get(channelParam)
+	if name == "" {
+		name = q.Get(scopeParam)
+	}
+	if name == "" && len(lists) > 0 {
+		return lists[0]
+	}
+
+	for _, pl := range lists {
+		if pl.Channel().Name == name {
+			return pl
+		}
+	}
+
+	return nil
+}
+
+// sharedConn lazily binds the ephemeral socket broadcast requests are sent via.
+//
+// The socket is shared by, and outlives, the requests since peers are sent to
+// asynchronously.
+type sharedConn struct {
+	mu     sync.Mutex
+	conn   net.PacketConn
+	closed bool
+}
+
+func (sc *sharedConn) get() (net.PacketConn, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	switch {
+	case sc.closed:
+		return nil, net.ErrClosed
+	case sc.conn != nil:
+		return sc.conn, nil
+	}
+
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	sc.conn = conn
+
+	return conn, nil
+}
+
+// close closes the socket of sc, if bound, and fails the calls to get which
+// follow.
+func (sc *sharedConn) close() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.conn != nil {
+		_ = sc.conn.Close()
+	}
+	sc.closed = true
+}
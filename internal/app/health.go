@@ -0,0 +1,51 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/azazeal/health"
+
+	"github.com/azazeal/flycast/internal/peer"
+)
+
+type healthResult struct {
+	Status    string             `json:"status"`
+	Failing   []string           `json:"failing,omitempty"`
+	Staleness map[string]float64 `json:"staleness"`
+}
+
+// healthCheck returns the handler which reports the health of hc along with
+// the staleness, in seconds, of the peer list of each channel.
+//
+// HEAD requests are served by hc itself.
+func healthCheck(hc *health.Check, lists ...*peer.List) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			hc.ServeHTTP(w, r)
+
+			return
+		}
+
+		res := healthResult{
+			Failing:   hc.Failing(nil),
+			Staleness: make(map[string]float64, len(lists)),
+		}
+		sort.Strings(res.Failing)
+
+		for _, pl := range lists {
+			res.Staleness[pl.Channel().Name] = pl.Staleness().Seconds()
+		}
+
+		code := http.StatusOK
+		if !hc.Healthy() {
+			code = http.StatusServiceUnavailable
+		}
+		res.Status = http.StatusText(code)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
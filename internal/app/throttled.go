@@ -0,0 +1,17 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/azazeal/flycast/internal/ratelimit"
+)
+
+// throttled returns the handler which lists the ports and sources the rate
+// limits of r currently throttle.
+func throttled(r *ratelimit.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(r.Throttled())
+	})
+}
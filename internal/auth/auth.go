@@ -0,0 +1,214 @@
+// Package auth implements the HMAC-SHA256 tags flycast authenticates the
+// packets it accepts and relays by.
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/azazeal/flycast/internal/dedup"
+	"github.com/azazeal/flycast/internal/metrics"
+)
+
+// HeaderSize denotes the size of the tag header.
+const HeaderSize = 54
+
+// signedSize denotes the size of the part of the header the MAC covers.
+const signedSize = HeaderSize - sha256.Size
+
+// magic is the wire prefix of tagged packets.
+var magic = [...]byte{'f', 'c', 'a', 1}
+
+// The set of tag types, which keep the packets signed for one purpose from
+// being accepted for another.
+const (
+	// TypeIngress denotes the tags of the packets clients send to flycast.
+	TypeIngress byte = iota + 1
+
+	// TypeRelay denotes the tags of the packets flycast relays to other
+	// flycast instances.
+	TypeRelay
+
+	// TypeReply denotes the tags of the replies flycast returns for the
+	// packets it receives on the relay port, i.e. the acknowledgements of
+	// reliable frames and the pongs of latency probes.
+	TypeReply
+)
+
+// kinds maps the tag types to the kind label of their metrics.
+var kinds = map[byte]string{
+	TypeIngress: "ingress",
+	TypeRelay:   "relay",
+	TypeReply:   "reply",
+}
+
+// The set of verification results.
+const (
+	resultAccepted        = "accepted"
+	resultUnauthenticated = "unauthenticated"
+	resultInvalid         = "invalid"
+	resultExpired         = "expired"
+	resultReplayed        = "replayed"
+)
+
+// Header wraps the properties of the tag header.
+type Header struct {
+	// Type denotes the purpose of the packet.
+	Type byte
+
+	// Key identifies the key the packet is signed with.
+	Key uint8
+
+	// Time denotes when the packet was signed.
+	Time time.Time
+
+	// Nonce identifies the packet amongst those signed at the same time.
+	Nonce uint64
+}
+
+// Sign returns a copy of payload, tagged with h and signed with key.
+func Sign(h Header, key, payload []byte) []byte {
+	b := make([]byte, HeaderSize+len(payload))
+
+	copy(b, magic[:])
+	b[4] = h.Type
+	b[5] = h.Key
+	binary.BigEndian.PutUint64(b[6:], uint64(h.Time.UnixNano()))
+	binary.BigEndian.PutUint64(b[14:], h.Nonce)
+	copy(b[HeaderSize:], payload)
+
+	copy(b[signedSize:], mac(key, b[:signedSize], payload))
+
+	return b
+}
+
+// Parse parses the tag b carries. It reports false in case b carries no tag.
+func Parse(b []byte) (h Header, payload []byte, ok bool) {
+	if len(b) < HeaderSize || string(b[:len(magic)]) != string(magic[:]) {
+		return
+	}
+
+	h.Type = b[4]
+	h.Key = b[5]
+	h.Time = time.Unix(0, int64(binary.BigEndian.Uint64(b[6:])))
+	h.Nonce = binary.BigEndian.Uint64(b[14:])
+
+	return h, b[HeaderSize:], true
+}
+
+func mac(key, header, payload []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	_, _ = m.Write(header)
+	_, _ = m.Write(payload)
+
+	return m.Sum(nil)
+}
+
+// Keyring signs and verifies packets with a set of keys, of which one is used
+// for signing, so that keys may be rotated by adding the new key to all
+// instances before signing with it.
+//
+// Keyring is safe for concurrent use.
+type Keyring struct {
+	keys   map[uint8][]byte
+	signer uint8
+	window time.Duration
+	seen   *dedup.Window[nonce]
+}
+
+type nonce struct {
+	key   uint8
+	nonce uint64
+}
+
+// NewKeyring returns a Keyring which signs with the key identified by signer
+// and accepts the packets signed with any of keys within window of the local
+// clock.
+func NewKeyring(keys map[uint8][]byte, signer uint8, window time.Duration) *Keyring {
+	return &Keyring{
+		keys:   keys,
+		signer: signer,
+		window: window,
+		seen:   dedup.New[nonce](window << 1),
+	}
+}
+
+// Sign returns a copy of payload, tagged with the given type and signed with
+// the signing key of kr. Sign is safe to call on a nil Keyring, in which case
+// payload is returned as is.
+func (kr *Keyring) Sign(typ byte, payload []byte) []byte {
+	if kr == nil {
+		return payload
+	}
+
+	var n [8]byte
+	_, _ = rand.Read(n[:])
+
+	return Sign(Header{
+		Type:  typ,
+		Key:   kr.signer,
+		Time:  time.Now(),
+		Nonce: binary.BigEndian.Uint64(n[:]),
+	}, kr.keys[kr.signer], payload)
+}
+
+// Verify returns the payload of the packet b carries in case it is tagged with
+// the given type, signed with one of the keys of kr, within its window and not
+// already seen.
+//
+// Verify is safe to call on a nil Keyring, in which case b is returned as is.
+func (kr *Keyring) Verify(typ byte, b []byte) ([]byte, bool) {
+	if kr == nil {
+		return b, true
+	}
+
+	payload, result := kr.verify(typ, b)
+	metrics.AuthPackets.WithLabelValues(kinds[typ], result).Inc()
+
+	return payload, result == resultAccepted
+}
+
+func (kr *Keyring) verify(typ byte, b []byte) ([]byte, string) {
+	h, payload, ok := Parse(b)
+	if !ok {
+		return nil, resultUnauthenticated
+	}
+
+	key, known := kr.keys[h.Key]
+	if !known || h.Type != typ {
+		return nil, resultInvalid
+	}
+
+	if !hmac.Equal(b[signedSize:HeaderSize], mac(key, b[:signedSize], payload)) {
+		return nil, resultInvalid
+	}
+
+	if age := time.Since(h.Time); age > kr.window || age < -kr.window {
+		return nil, resultExpired
+	}
+
+	if !kr.seen.Admit(nonce{h.Key, h.Nonce}) {
+		return nil, resultReplayed
+	}
+
+	return payload, resultAccepted
+}
+
+type contextKeyType struct{}
+
+// FromContext returns the Keyring the given Context carries, or nil in case it
+// carries none.
+func FromContext(ctx context.Context) *Keyring {
+	kr, _ := ctx.Value(contextKeyType{}).(*Keyring)
+
+	return kr
+}
+
+// NewContext returns a copy of ctx which carries kr.
+func NewContext(ctx context.Context, kr *Keyring) context.Context {
+	return context.WithValue(ctx, contextKeyType{}, kr)
+}
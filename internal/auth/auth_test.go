@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	const window = 30 * time.Second
+
+	var (
+		payload = []byte("payload")
+		keys    = map[uint8][]byte{
+			1: []byte("0123456789abcdef"),
+			2: []byte("fedcba9876543210"),
+		}
+		unknown = []byte("an unknown secret")
+	)
+
+	sign := func(typ, key byte, secret []byte, at time.Time) []byte {
+		return Sign(Header{Type: typ, Key: key, Time: at, Nonce: uint64(at.UnixNano())}, secret, payload)
+	}
+
+	cases := []struct {
+		name     string
+		typ      byte
+		packet   func(kr *Keyring) []byte
+		expected string
+	}{
+		{
+			name:     "signed by the keyring",
+			typ:      TypeRelay,
+			packet:   func(kr *Keyring) []byte { return kr.Sign(TypeRelay, payload) },
+			expected: resultAccepted,
+		},
+		{
+			name:     "signed with another known key",
+			typ:      TypeIngress,
+			packet:   func(*Keyring) []byte { return sign(TypeIngress, 2, keys[2], time.Now()) },
+			expected: resultAccepted,
+		},
+		{
+			name:     "untagged",
+			typ:      TypeIngress,
+			packet:   func(*Keyring) []byte { return payload },
+			expected: resultUnauthenticated,
+		},
+		{
+			name:     "wrong type",
+			typ:      TypeIngress,
+			packet:   func(kr *Keyring) []byte { return kr.Sign(TypeRelay, payload) },
+			expected: resultInvalid,
+		},
+		{
+			name:     "unknown key",
+			typ:      TypeIngress,
+			packet:   func(*Keyring) []byte { return sign(TypeIngress, 3, unknown, time.Now()) },
+			expected: resultInvalid,
+		},
+		{
+			name:     "known ID, wrong secret",
+			typ:      TypeIngress,
+			packet:   func(*Keyring) []byte { return sign(TypeIngress, 1, unknown, time.Now()) },
+			expected: resultInvalid,
+		},
+		{
+			name: "tampered payload",
+			typ:  TypeRelay,
+			packet: func(kr *Keyring) []byte {
+				b := kr.Sign(TypeRelay, payload)
+				b[len(b)-1] ^= 1
+
+				return b
+			},
+			expected: resultInvalid,
+		},
+		{
+			name: "tampered header",
+			typ:  TypeRelay,
+			packet: func(kr *Keyring) []byte {
+				b := kr.Sign(TypeRelay, payload)
+				b[14] ^= 1 // the nonce
+
+				return b
+			},
+			expected: resultInvalid,
+		},
+		{
+			name:     "expired",
+			typ:      TypeIngress,
+			packet:   func(*Keyring) []byte { return sign(TypeIngress, 1, keys[1], time.Now().Add(-2*window)) },
+			expected: resultExpired,
+		},
+		{
+			name:     "from the future",
+			typ:      TypeIngress,
+			packet:   func(*Keyring) []byte { return sign(TypeIngress, 1, keys[1], time.Now().Add(2*window)) },
+			expected: resultExpired,
+		},
+		{
+			name: "replayed",
+			typ:  TypeReply,
+			packet: func(kr *Keyring) []byte {
+				b := kr.Sign(TypeReply, payload)
+				_, _ = kr.Verify(TypeReply, b) // the original
+
+				return b
+			},
+			expected: resultReplayed,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			kr := NewKeyring(keys, 1, window)
+
+			got, result := kr.verify(c.typ, c.packet(kr))
+			if result != c.expected {
+				t.Fatalf("expected %s, got %s", c.expected, result)
+			}
+			if c.expected == resultAccepted && !bytes.Equal(got, payload) {
+				t.Errorf("expected %q, got %q", payload, got)
+			}
+		})
+	}
+}
+
+func TestNilKeyring(t *testing.T) {
+	var kr *Keyring
+
+	payload := []byte("payload")
+	if b := kr.Sign(TypeRelay, payload); !bytes.Equal(b, payload) {
+		t.Errorf("a nil keyring signed: %q", b)
+	}
+	if b, ok := kr.Verify(TypeRelay, payload); !ok || !bytes.Equal(b, payload) {
+		t.Errorf("a nil keyring altered or rejected: %q", b)
+	}
+}
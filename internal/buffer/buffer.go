@@ -2,8 +2,9 @@ package buffer
 
 import "sync"
 
-// Size denotes the size of all buffers.
-const Size = 1 << 14
+// Size denotes the size of all buffers. It fits the largest possible UDP
+// datagram.
+const Size = 1 << 16
 
 type Buffer [Size]byte
 
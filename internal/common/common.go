@@ -1,4 +1,22 @@
 // Package common implements functionality consumed by other packages.
+//
+// # Wire prefixes
+//
+// Whatever flycast frames on the wire starts with a 4 byte prefix; the letters
+// "fc", followed by a letter which identifies the framing and by a byte which
+// denotes the version of its format (currently 1):
+//
+//	fca	authentication tags (auth)
+//	fce	envelopes (envelope)
+//	fcf	fragments (fragment)
+//	fcp	latency probes (latency)
+//	fcr	reliable frames (reliable)
+//	fct	relayed truncated packets (wire)
+//	fcx	sealed payloads (seal)
+//
+// Prefixes tell the framings apart where they nest, and a framing which
+// changes its format bumps its version, so that instances which do not know
+// of the new format do not mistake it for the old one.
 package common
 
 import (
@@ -29,13 +47,22 @@ const (
 
 // health check names
 const (
-	HCRefreshGlobalComponent = "refresh.global"
-	HCRefreshLocalComponent  = "refresh.local"
-	HCAppComponent           = "app"
-	HCWireGlobal             = "wire.global"
-	HCWireLocal              = "wire.local"
+	HCRefresh          = "refresh"
+	HCAppComponent     = "app"
+	HCPrivateComponent = "private"
+	HCWire             = "wire"
+	HCReliable         = "reliable"
+	HCRelay            = "relay"
+	HCProbe            = "probe"
+	HCPong             = "pong"
 )
 
+// ChannelComponent returns the name of the health check component of the
+// given subsystem (i.e. HCRefresh) for the named channel.
+func ChannelComponent(subsystem, channel string) string {
+	return subsystem + "." + channel
+}
+
 // CloseOnce wraps closer with a sync.Once so that it may only be closed once.
 func CloseOnce(closer io.Closer) io.Closer {
 	return &closeOnce{
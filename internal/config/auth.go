@@ -0,0 +1,62 @@
+package config
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	authKeysKey    = "AUTH_KEYS"
+	authKeyKey     = "AUTH_KEY"
+	authIngressKey = "AUTH_INGRESS"
+	authRelayKey   = "AUTH_RELAY"
+	authWindowKey  = "AUTH_WINDOW"
+)
+
+// minAuthKeySize denotes the minimum size of authentication keys.
+const minAuthKeySize = 16
+
+// Auth wraps the authentication configuration.
+type Auth struct {
+	// Keys holds the parsed value of the AUTH_KEYS environment variable,
+	// keyed by ID.
+	Keys map[uint8][]byte
+
+	// Key holds the parsed value of the AUTH_KEY environment variable.
+	Key uint8
+
+	// Ingress holds the value of the AUTH_INGRESS environment variable.
+	Ingress bool
+
+	// Relay holds the value of the AUTH_RELAY environment variable.
+	Relay bool
+
+	// Window holds the value of the AUTH_WINDOW environment variable.
+	Window time.Duration
+}
+
+// setAuth sets the authentication configuration of cfg. The keys are only
+// required when authentication is enabled, and the signing key defaults to
+// the first one listed.
+func setAuth(logger *zap.Logger, cfg *Config) bool {
+	var keys, ingress, relay, window string
+
+	ok := fetch(&ingress, authIngressKey, "false") &&
+		setBool(logger, &cfg.Auth.Ingress, authIngressKey, ingress) &&
+		fetch(&relay, authRelayKey, "false") &&
+		setBool(logger, &cfg.Auth.Relay, authRelayKey, relay) &&
+		fetch(&window, authWindowKey, "30s") &&
+		setDuration(logger, &cfg.Auth.Window, authWindowKey, window) &&
+		fetch(&keys, authKeysKey, "") &&
+		required(logger, authKeysKey, keys != "" || !(cfg.Auth.Ingress || cfg.Auth.Relay))
+	if !ok || keys == "" {
+		return ok
+	}
+
+	return setKeys(logger, &cfg.Auth.Keys, &cfg.Auth.Key, authKeysKey, authKeyKey, keys, validAuthKey)
+}
+
+func validAuthKey(b []byte) bool {
+	return len(b) >= minAuthKeySize
+}
@@ -0,0 +1,360 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// The set of scopes a Channel may broadcast to, besides explicit region lists.
+const (
+	// ScopeGlobal denotes the scope of all the instances of an app.
+	ScopeGlobal = "global"
+
+	// ScopeLocal denotes the scope of the instances of an app which run in
+	// the local region.
+	ScopeLocal = "local"
+
+	// ScopeNearest prefixes the scopes of the instances of an app which run in
+	// the local region and the N regions nearest to it (i.e. nearest:3).
+	ScopeNearest = "nearest:"
+)
+
+// The set of modes a Channel may deliver in.
+const (
+	// ModeBroadcast denotes delivery to every peer.
+	ModeBroadcast = "broadcast"
+
+	// ModeRandom denotes delivery to a random peer or, when followed by a
+	// colon and a positive number (i.e. random:3), to as many distinct random
+	// peers.
+	ModeRandom = "random"
+
+	// ModeHash denotes delivery to the peer a consistent hash of each packet
+	// selects. When followed by a colon and a positive number (i.e. hash:8),
+	// only as many leading bytes of the packet are hashed.
+	ModeHash = "hash"
+
+	// ModeLowestLatency denotes delivery to a peer of the region with the
+	// lowest latency estimate.
+	ModeLowestLatency = "lowest-latency"
+)
+
+// Channel wraps the properties of a broadcast channel.
+type Channel struct {
+	// Name holds the value of the CHANNEL_n_NAME environment variable.
+	Name string
+
+	// Port holds the value of the CHANNEL_n_PORT environment variable.
+	Port int
+
+	// App holds the value of the CHANNEL_n_APP environment variable.
+	App string
+
+	// Scope holds the value of the CHANNEL_n_SCOPE environment variable.
+	Scope string
+
+	// Regions holds the regions Scope denotes, or nil for ScopeGlobal and
+	// ScopeNearest.
+	Regions []string
+
+	// Nearest holds the number of regions, besides the local one, a
+	// ScopeNearest scope denotes.
+	Nearest int
+
+	// Relay holds the value of the CHANNEL_n_RELAY environment variable.
+	Relay int
+
+	// Truncated holds the value of the CHANNEL_n_TRUNCATED environment
+	// variable.
+	Truncated string
+
+	// MaxSize holds the value of the CHANNEL_n_MAX_SIZE environment
+	// variable.
+	MaxSize int
+
+	// Bind holds the value of the CHANNEL_n_BIND environment variable.
+	Bind string
+
+	// ACL holds the parsed values of the CHANNEL_n_ALLOW and CHANNEL_n_DENY
+	// environment variables.
+	ACL ACL
+
+	// Rate holds the values of the CHANNEL_n_RATE_* environment variables.
+	Rate Rate
+
+	// Mode holds the delivery mode the CHANNEL_n_MODE environment variable
+	// denotes, without its argument.
+	Mode string
+
+	// Fanout holds the number of peers a ModeRandom mode denotes.
+	Fanout int
+
+	// HashPrefix holds the number of leading bytes a ModeHash mode denotes,
+	// or 0 for the whole packet.
+	HashPrefix int
+
+	// Raw holds the value of the CHANNEL_n_RAW environment variable. Raw
+	// channels relay packets without the framing of the reliable,
+	// fragmentation, authentication and encryption options.
+	Raw bool
+}
+
+// String implements fmt.Stringer for Channel.
+func (ch *Channel) String() string {
+	return fmt.Sprintf("%s(port=%d bind=%s %s %s app=%s scope=%s relay=%d truncated=%s maxsize=%d mode=%s raw=%t)",
+		ch.Name, ch.Port, ch.Bind, &ch.ACL, &ch.Rate, ch.App, ch.Scope, ch.Relay, ch.Truncated, ch.MaxSize, ch.mode(), ch.Raw)
+}
+
+// mode returns the delivery mode of ch along with its argument, if any.
+func (ch *Channel) mode() string {
+	switch {
+	case ch.Mode == ModeRandom && ch.Fanout > 1:
+		return ModeRandom + ":" + strconv.Itoa(ch.Fanout)
+	case ch.Mode == ModeHash && ch.HashPrefix > 0:
+		return ModeHash + ":" + strconv.Itoa(ch.HashPrefix)
+	default:
+		return ch.Mode
+	}
+}
+
+func channels(chs []Channel) []string {
+	ret := make([]string, 0, len(chs))
+	for i := range chs {
+		ret = append(ret, chs[i].String())
+	}
+
+	return ret
+}
+
+// channelKey matches the indexed environment variables channels are
+// configured via.
+var channelKey = regexp.MustCompile(`^CHANNEL_([0-9]+)_`)
+
+// channelIndexes returns the sorted, distinct indexes of the channels the
+// environment configures.
+func channelIndexes() (indexes []int) {
+	seen := make(map[int]struct{})
+	for _, kv := range os.Environ() {
+		m := channelKey.FindStringSubmatch(kv)
+		if m == nil {
+			continue
+		}
+
+		if n, err := strconv.Atoi(m[1]); err == nil {
+			if _, dup := seen[n]; !dup {
+				seen[n] = struct{}{}
+				indexes = append(indexes, n)
+			}
+		}
+	}
+	sort.Ints(indexes)
+
+	return
+}
+
+// setChannels sets the channels of cfg; either those the CHANNEL_n_*
+// environment variables configure, or, when none are set, the global and
+// local channels of the legacy PORT_GLOBAL and PORT_LOCAL ports, which deliver
+// in the modes MODE_GLOBAL and MODE_LOCAL denote.
+func setChannels(logger *zap.Logger, cfg *Config) bool {
+	groups, ok := loadRegionGroups(logger)
+	if !ok {
+		return false
+	}
+	cfg.RegionGroups = groups
+
+	indexes := channelIndexes()
+	if len(indexes) == 0 {
+		cfg.Channels = []Channel{
+			{
+				Name:      ScopeGlobal,
+				Port:      cfg.Ports.Global,
+				App:       cfg.App,
+				Scope:     ScopeGlobal,
+				Relay:     cfg.Ports.Relay,
+				Truncated: cfg.Truncated.Global,
+				MaxSize:   cfg.MaxSize,
+				Bind:      cfg.Bind.Global,
+				ACL:       cfg.ACL.Global,
+				Rate:      cfg.Rate,
+			},
+			{
+				Name:      ScopeLocal,
+				Port:      cfg.Ports.Local,
+				App:       cfg.App,
+				Scope:     ScopeLocal,
+				Regions:   []string{cfg.Region},
+				Relay:     cfg.Ports.Relay,
+				Truncated: cfg.Truncated.Local,
+				MaxSize:   cfg.MaxSize,
+				Bind:      cfg.Bind.Local,
+				ACL:       cfg.ACL.Local,
+				Rate:      cfg.Rate,
+			},
+		}
+
+		var modeGlobal, modeLocal string
+
+		return fetch(&modeGlobal, modeGlobalKey, ModeBroadcast) &&
+			setMode(logger, &cfg.Channels[0], modeGlobalKey, modeGlobal) &&
+			fetch(&modeLocal, modeLocalKey, ModeBroadcast) &&
+			setMode(logger, &cfg.Channels[1], modeLocalKey, modeLocal)
+	}
+
+	var (
+		names = make(map[string]struct{}, len(indexes))
+		ports = make(map[int]struct{}, len(indexes))
+	)
+	for _, n := range indexes {
+		ch, ok := loadChannel(logger, cfg, n)
+		if !ok {
+			return false
+		}
+
+		if _, dup := names[ch.Name]; dup {
+			logger.Error("a channel name is not unique.",
+				envVar(channelVar(n, "NAME")))
+
+			return false
+		}
+		names[ch.Name] = struct{}{}
+
+		if _, dup := ports[ch.Port]; dup {
+			logger.Error("a channel port is not unique.",
+				envVar(channelVar(n, "PORT")))
+
+			return false
+		}
+		ports[ch.Port] = struct{}{}
+
+		cfg.Channels = append(cfg.Channels, ch)
+	}
+
+	return true
+}
+
+func loadChannel(logger *zap.Logger, cfg *Config, n int) (ch Channel, ok bool) {
+	var (
+		nameKey      = channelVar(n, "NAME")
+		portKey      = channelVar(n, "PORT")
+		appKey       = channelVar(n, "APP")
+		scopeKey     = channelVar(n, "SCOPE")
+		relayKey     = channelVar(n, "RELAY")
+		truncatedKey = channelVar(n, "TRUNCATED")
+		maxSizeKey   = channelVar(n, "MAX_SIZE")
+		modeKey      = channelVar(n, "MODE")
+		bindKey      = channelVar(n, "BIND")
+		allowKey     = channelVar(n, "ALLOW")
+		denyKey      = channelVar(n, "DENY")
+		rawKey       = channelVar(n, "RAW")
+
+		port, relay, maxSize, mode, allow, deny, raw string
+	)
+
+	ok = fetch(&ch.Name, nameKey, "channel"+strconv.Itoa(n)) &&
+		required(logger, nameKey, ch.Name != "") &&
+		fetch(&port, portKey, "") &&
+		required(logger, portKey, port != "") &&
+		setPort(logger, &ch.Port, portKey, port) &&
+		fetch(&ch.App, appKey, cfg.App) &&
+		required(logger, appKey, ch.App != "") &&
+		fetch(&ch.Scope, scopeKey, ScopeGlobal) &&
+		setScope(logger, &ch, scopeKey, cfg.Region, cfg.RegionGroups) &&
+		fetch(&relay, relayKey, strconv.Itoa(cfg.Ports.Relay)) &&
+		setPort(logger, &ch.Relay, relayKey, relay) &&
+		fetch(&ch.Truncated, truncatedKey, TruncatedDrop) &&
+		validTruncation(logger, truncatedKey, ch.Truncated) &&
+		fetch(&maxSize, maxSizeKey, strconv.Itoa(cfg.MaxSize)) &&
+		setMaxSize(logger, &ch.MaxSize, maxSizeKey, maxSize) &&
+		fetch(&mode, modeKey, ModeBroadcast) &&
+		setMode(logger, &ch, modeKey, mode) &&
+		fetch(&ch.Bind, bindKey, BindWildcard) &&
+		validBind(logger, bindKey, ch.Bind) &&
+		fetch(&allow, allowKey, "") &&
+		setSources(logger, &ch.ACL.Allow, allowKey, allow) &&
+		fetch(&deny, denyKey, "") &&
+		setSources(logger, &ch.ACL.Deny, denyKey, deny) &&
+		setRates(logger, &ch.Rate, channelVar(n, ratePrefix), cfg.Rate) &&
+		fetch(&raw, rawKey, "false") &&
+		setBool(logger, &ch.Raw, rawKey, raw)
+
+	return
+}
+
+// setScope sets the regions of ch according to its scope, which is either
+// ScopeGlobal, ScopeNearest followed by a positive number, or a comma
+// separated list of regions, region groups and ScopeLocal.
+func setScope(logger *zap.Logger, ch *Channel, key, local string, groups map[string][]string) bool {
+	switch {
+	case ch.Scope == ScopeGlobal:
+		return true
+	case strings.HasPrefix(ch.Scope, ScopeNearest):
+		n, err := strconv.Atoi(strings.TrimPrefix(ch.Scope, ScopeNearest))
+		if err != nil || n < 1 {
+			logger.Error("a channel scope environment variable is invalid.",
+				envVar(key))
+
+			return false
+		}
+		ch.Nearest = n
+
+		return true
+	}
+
+	if ch.Regions = expandRegions(ch.Scope, local, groups); len(ch.Regions) == 0 {
+		logger.Error("a channel scope environment variable is invalid.",
+			envVar(key))
+
+		return false
+	}
+
+	return true
+}
+
+// setMode sets the delivery mode of ch to the given one, which is either
+// ModeBroadcast, ModeLowestLatency, or ModeRandom or ModeHash, optionally
+// followed by a colon and a positive number.
+func setMode(logger *zap.Logger, ch *Channel, key, mode string) bool {
+	name, arg, hasArg := strings.Cut(mode, ":")
+
+	n := 0
+	if hasArg {
+		var err error
+		if n, err = strconv.Atoi(arg); err != nil || n < 1 {
+			logger.Error("a channel mode environment variable is invalid.",
+				envVar(key))
+
+			return false
+		}
+	}
+
+	switch {
+	case name == ModeRandom:
+		ch.Fanout = 1
+		if hasArg {
+			ch.Fanout = n
+		}
+	case name == ModeHash:
+		ch.HashPrefix = n
+	case !hasArg && (name == ModeBroadcast || name == ModeLowestLatency):
+		// these modes take no argument
+	default:
+		logger.Error("a channel mode environment variable is invalid.",
+			envVar(key))
+
+		return false
+	}
+	ch.Mode = name
+
+	return true
+}
+
+func channelVar(n int, suffix string) string {
+	return "CHANNEL_" + strconv.Itoa(n) + "_" + suffix
+}
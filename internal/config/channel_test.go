@@ -0,0 +1,81 @@
+package config
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestLegacyModes(t *testing.T) {
+	cases := []struct {
+		name       string
+		global     string // unset when empty
+		local      string // unset when empty
+		expected   [2]string
+		fanout     int
+		hashPrefix int
+		invalid    bool
+	}{
+		{
+			name:     "defaults",
+			expected: [2]string{ModeBroadcast, ModeBroadcast},
+		},
+		{
+			name:     "set",
+			global:   "random:3",
+			local:    ModeLowestLatency,
+			expected: [2]string{ModeRandom, ModeLowestLatency},
+			fanout:   3,
+		},
+		{
+			name:       "hash",
+			global:     "hash:8",
+			expected:   [2]string{ModeHash, ModeBroadcast},
+			hashPrefix: 8,
+		},
+		{
+			name:    "invalid global",
+			global:  "anycast",
+			invalid: true,
+		},
+		{
+			name:    "invalid local",
+			local:   "random:0",
+			invalid: true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			if c.global != "" {
+				t.Setenv(modeGlobalKey, c.global)
+			}
+			if c.local != "" {
+				t.Setenv(modeLocalKey, c.local)
+			}
+
+			cfg := &Config{Region: "ord"}
+			if ok := setChannels(zap.NewNop(), cfg); ok == c.invalid {
+				t.Fatalf("expected valid to be %t", !c.invalid)
+			} else if !ok {
+				return
+			}
+
+			if len(cfg.Channels) != 2 {
+				t.Fatalf("expected the global and local channels, got %d", len(cfg.Channels))
+			}
+			for i, mode := range c.expected {
+				if got := cfg.Channels[i].Mode; got != mode {
+					t.Errorf("channel %d: expected mode %q, got %q", i, mode, got)
+				}
+			}
+			if got := cfg.Channels[0].Fanout; got != c.fanout {
+				t.Errorf("expected a fanout of %d, got %d", c.fanout, got)
+			}
+			if got := cfg.Channels[0].HashPrefix; got != c.hashPrefix {
+				t.Errorf("expected a hash prefix of %d, got %d", c.hashPrefix, got)
+			}
+		})
+	}
+}
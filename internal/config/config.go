@@ -3,30 +3,140 @@ package config
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"math"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/azazeal/exit"
 	"github.com/azazeal/fly/env"
 	"go.uber.org/zap"
 
 	"github.com/azazeal/flycast/internal/common"
+	"github.com/azazeal/flycast/internal/discovery"
+	"github.com/azazeal/flycast/internal/fragment"
 )
 
+// The set of modes the application may run in.
 const (
-	appKey        = "APP"
-	globalPortKey = "PORT_GLOBAL"
-	localPortKey  = "PORT_LOCAL"
-	relayPortKey  = "PORT_RELAY"
-	httpPortKey   = "PORT_HTTP"
+	// ModeFly denotes the mode in which the application expects to run on
+	// Fly.
+	ModeFly = "fly"
+
+	// ModeStandalone denotes the mode in which the application sources from
+	// its configuration everything it would otherwise source from the Fly
+	// environment.
+	ModeStandalone = "standalone"
 )
 
+// The set of policies for truncated packets.
+const (
+	// TruncatedDrop denotes the policy of dropping truncated packets.
+	TruncatedDrop = "drop"
+
+	// TruncatedMark denotes the policy of relaying truncated packets prefixed
+	// with a marker.
+	TruncatedMark = "mark"
+)
+
+// The set of special addresses ports may be bound to.
+const (
+	// BindWildcard denotes all of the local addresses.
+	BindWildcard = "*"
+
+	// BindFlyGlobalServices denotes the address Fly routes the public UDP
+	// traffic of an app to.
+	BindFlyGlobalServices = "fly-global-services"
+)
+
+// The set of policies for peer lists which have gone stale.
+const (
+	// StaleKeep denotes the policy of sending to the last known good peers
+	// for as long as resolutions fail.
+	StaleKeep = "keep"
+
+	// StaleClear denotes the policy of clearing peer lists which have gone
+	// stale for longer than the maximum staleness.
+	StaleClear = "clear"
+)
+
+const (
+	modeKey        = "FLYCAST_MODE"
+	instanceKey    = "INSTANCE"
+	regionKey      = "REGION"
+	appKey         = "APP"
+	globalPortKey  = "PORT_GLOBAL"
+	localPortKey   = "PORT_LOCAL"
+	relayPortKey   = "PORT_RELAY"
+	probePortKey   = "PORT_PROBE"
+	httpPortKey    = "PORT_HTTP"
+	privatePortKey = "PORT_PRIVATE"
+
+	discoveryKey     = "DISCOVERY"
+	peersKey         = "PEERS"
+	discoveryDNSKey  = "DISCOVERY_DNS"
+	discoveryFileKey = "DISCOVERY_FILE"
+
+	envelopeKey       = "ENVELOPE"
+	envelopeWindowKey = "ENVELOPE_WINDOW"
+
+	reliableKey         = "RELIABLE"
+	reliableDeadlineKey = "RELIABLE_DEADLINE"
+	deliverKey          = "DELIVER"
+	fragmentSizeKey     = "FRAGMENT_SIZE"
+	maxSizeKey          = "MAX_SIZE"
+
+	truncatedGlobalKey = "TRUNCATED_GLOBAL"
+	truncatedLocalKey  = "TRUNCATED_LOCAL"
+
+	bindGlobalKey = "BIND_GLOBAL"
+	bindLocalKey  = "BIND_LOCAL"
+
+	modeGlobalKey = "MODE_GLOBAL"
+	modeLocalKey  = "MODE_LOCAL"
+
+	allowGlobalKey = "ALLOW_GLOBAL"
+	denyGlobalKey  = "DENY_GLOBAL"
+	allowLocalKey  = "ALLOW_LOCAL"
+	denyLocalKey   = "DENY_LOCAL"
+	allowRelayKey  = "ALLOW_RELAY"
+	denyRelayKey   = "DENY_RELAY"
+
+	refreshIntervalKey = "REFRESH_INTERVAL"
+	refreshMaxKey      = "REFRESH_MAX"
+
+	staleMaxKey    = "STALE_MAX"
+	stalePolicyKey = "STALE_POLICY"
+
+	excludeSelfKey = "EXCLUDE_SELF"
+	privateIPKey   = "PRIVATE_IP"
+
+	latenciesKey = "LATENCIES"
+	probeKey     = "PROBE"
+)
+
+// flyPrivateIPKey denotes the environment variable Fly sets to the 6PN
+// address of the instance.
+const flyPrivateIPKey = "FLY_PRIVATE_IP"
+
 // Config wraps the properties of the configuration.
 type Config struct {
+	// Mode holds the value of the FLYCAST_MODE environment variable.
+	Mode string
+
+	// Instance holds the value of the INSTANCE environment variable.
+	Instance string
+
 	// App holds the value of the APP environment variable.
 	App string
 
+	// Region holds the value of the REGION environment variable.
+	Region string
+
 	Ports struct {
 		// Global holds the value of the PORT_GLOBAL environment variable.
 		Global int
@@ -37,22 +147,232 @@ type Config struct {
 		// Relay holds the value of the PORT_RELAY environment variable.
 		Relay int
 
+		// Probe holds the value of the PORT_PROBE environment variable.
+		Probe int
+
 		// HTTP holds the value of the PORT_HTTP environment variable.
 		HTTP int
+
+		// Private holds the value of the PORT_PRIVATE environment variable.
+		Private int
+	}
+
+	Discovery struct {
+		// Backend holds the value of the DISCOVERY environment variable.
+		Backend string
+
+		// Peers holds the parsed value of the PEERS environment variable.
+		Peers []discovery.Instance
+
+		// DNS holds the value of the DISCOVERY_DNS environment variable.
+		DNS string
+
+		// File holds the value of the DISCOVERY_FILE environment variable.
+		File string
+	}
+
+	Envelope struct {
+		// Enabled holds the value of the ENVELOPE environment variable.
+		Enabled bool
+
+		// Window holds the value of the ENVELOPE_WINDOW environment
+		// variable.
+		Window time.Duration
+	}
+
+	Reliable struct {
+		// Enabled holds the value of the RELIABLE environment variable.
+		Enabled bool
+
+		// Deadline holds the value of the RELIABLE_DEADLINE environment
+		// variable.
+		Deadline time.Duration
+	}
+
+	// Deliver holds the parsed value of the DELIVER environment variable.
+	Deliver []Destination
+
+	Fragment struct {
+		// Size holds the value of the FRAGMENT_SIZE environment variable.
+		Size int
+	}
+
+	// MaxSize holds the value of the MAX_SIZE environment variable.
+	MaxSize int
+
+	Truncated struct {
+		// Global holds the value of the TRUNCATED_GLOBAL environment
+		// variable.
+		Global string
+
+		// Local holds the value of the TRUNCATED_LOCAL environment variable.
+		Local string
+	}
+
+	Bind struct {
+		// Global holds the value of the BIND_GLOBAL environment variable.
+		Global string
+
+		// Local holds the value of the BIND_LOCAL environment variable.
+		Local string
+	}
+
+	ACL struct {
+		// Global holds the parsed values of the ALLOW_GLOBAL and
+		// DENY_GLOBAL environment variables.
+		Global ACL
+
+		// Local holds the parsed values of the ALLOW_LOCAL and DENY_LOCAL
+		// environment variables.
+		Local ACL
+
+		// Relay holds the parsed values of the ALLOW_RELAY and DENY_RELAY
+		// environment variables.
+		Relay ACL
+	}
+
+	Refresh struct {
+		// Interval holds the value of the REFRESH_INTERVAL environment
+		// variable.
+		Interval time.Duration
+
+		// Max holds the value of the REFRESH_MAX environment variable.
+		Max time.Duration
+	}
+
+	Stale struct {
+		// Max holds the value of the STALE_MAX environment variable.
+		Max time.Duration
+
+		// Policy holds the value of the STALE_POLICY environment variable.
+		Policy string
+	}
+
+	// Channels holds the channels the CHANNEL_n_* environment variables
+	// configure or, when none are set, the global and local channels.
+	Channels []Channel
+
+	Latency struct {
+		// Static holds the parsed value of the LATENCIES environment
+		// variable.
+		Static map[string]time.Duration
+
+		// Probe holds the value of the PROBE environment variable.
+		Probe bool
+	}
+
+	// RegionGroups holds the built-in region groups along with those the
+	// REGION_GROUP_<NAME> environment variables define, keyed by name.
+	RegionGroups map[string][]string
+
+	// Auth holds the configuration of the AUTH_* environment variables.
+	Auth Auth
+
+	// Encrypt holds the configuration of the ENCRYPT_* environment
+	// variables.
+	Encrypt Encrypt
+
+	// Rate holds the configuration of the RATE_* environment variables.
+	Rate Rate
+
+	// RelayRate holds the configuration of the RATE_RELAY_* environment
+	// variables.
+	RelayRate Rate
+
+	Self struct {
+		// Exclude holds the value of the EXCLUDE_SELF environment variable.
+		Exclude bool
+
+		// PrivateIP holds the parsed value of the PRIVATE_IP environment
+		// variable.
+		PrivateIP net.IP
 	}
 }
 
 // Fields the Config in the form of a slice of zap.Field.
 func (cfg *Config) Fields() []zap.Field {
 	return []zap.Field{
+		zap.String("mode", cfg.Mode),
+		zap.String("instance", cfg.Instance),
 		zap.String("app", cfg.App),
+		zap.String("region", cfg.Region),
 		zap.Int("port.global", cfg.Ports.Global),
 		zap.Int("port.local", cfg.Ports.Local),
 		zap.Int("port.relay", cfg.Ports.Relay),
+		zap.Int("port.probe", cfg.Ports.Probe),
 		zap.Int("port.http", cfg.Ports.HTTP),
+		zap.Int("port.private", cfg.Ports.Private),
+		zap.String("discovery", cfg.Discovery.Backend),
+		zap.Strings("discovery.peers", instances(cfg.Discovery.Peers)),
+		zap.String("discovery.dns", cfg.Discovery.DNS),
+		zap.String("discovery.file", cfg.Discovery.File),
+		zap.Bool("envelope", cfg.Envelope.Enabled),
+		zap.Duration("envelope.window", cfg.Envelope.Window),
+		zap.Bool("reliable", cfg.Reliable.Enabled),
+		zap.Duration("reliable.deadline", cfg.Reliable.Deadline),
+		zap.Strings("deliver", destinations(cfg.Deliver)),
+		zap.Int("fragment.size", cfg.Fragment.Size),
+		zap.Int("maxsize", cfg.MaxSize),
+		zap.String("truncated.global", cfg.Truncated.Global),
+		zap.String("truncated.local", cfg.Truncated.Local),
+		zap.String("bind.global", cfg.Bind.Global),
+		zap.String("bind.local", cfg.Bind.Local),
+		zap.Stringer("acl.global", &cfg.ACL.Global),
+		zap.Stringer("acl.local", &cfg.ACL.Local),
+		zap.Stringer("acl.relay", &cfg.ACL.Relay),
+		zap.Duration("refresh.interval", cfg.Refresh.Interval),
+		zap.Duration("refresh.max", cfg.Refresh.Max),
+		zap.Duration("stale.max", cfg.Stale.Max),
+		zap.String("stale.policy", cfg.Stale.Policy),
+		zap.Strings("channels", channels(cfg.Channels)),
+		zap.Strings("region.groups", regionGroupNames(cfg.RegionGroups)),
+		zap.Any("latency.static", cfg.Latency.Static),
+		zap.Bool("latency.probe", cfg.Latency.Probe),
+		zap.Bool("self.exclude", cfg.Self.Exclude),
+		zap.String("self.ip", ipString(cfg.Self.PrivateIP)),
+		zap.Bool("auth.ingress", cfg.Auth.Ingress),
+		zap.Bool("auth.relay", cfg.Auth.Relay),
+		zap.Ints("auth.keys", keyIDs(cfg.Auth.Keys)),
+		zap.Uint8("auth.key", cfg.Auth.Key),
+		zap.Duration("auth.window", cfg.Auth.Window),
+		zap.Bool("encrypt", cfg.Encrypt.Enabled),
+		zap.Ints("encrypt.keys", keyIDs(cfg.Encrypt.Keys)),
+		zap.Uint8("encrypt.key", cfg.Encrypt.Key),
+		zap.Float64("rate.source.packets", cfg.Rate.SourcePackets),
+		zap.Float64("rate.source.bytes", cfg.Rate.SourceBytes),
+		zap.Float64("rate.port.packets", cfg.Rate.PortPackets),
+		zap.Float64("rate.port.bytes", cfg.Rate.PortBytes),
+		zap.Duration("rate.burst", cfg.Rate.Burst),
+		zap.Stringer("rate.relay", &cfg.RelayRate),
 	}
 }
 
+func instances(insts []discovery.Instance) []string {
+	ret := make([]string, 0, len(insts))
+	for _, inst := range insts {
+		ret = append(ret, inst.String())
+	}
+
+	return ret
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
+}
+
+func destinations(dsts []Destination) []string {
+	ret := make([]string, 0, len(dsts))
+	for _, d := range dsts {
+		ret = append(ret, d.String())
+	}
+
+	return ret
+}
+
 type contextKeyType struct{}
 
 // FromContext returns the Config the given Context carries.
@@ -84,17 +404,47 @@ func Load(logger *zap.Logger) (*Config, error) {
 	logger = logger.Named(pkg)
 	logger.Info("loading configuration ...")
 
-	if !env.IsSet() {
+	var cfg Config
+	if !fetch(&cfg.Mode, modeKey, ModeFly) || !validMode(logger, cfg.Mode) {
+		return nil, errLoadConfig
+	}
+
+	// the defaults which, when running on fly, are sourced from its
+	// environment
+	instance, appName, regionName, backend := env.AllocID(), env.AppName(), env.Region(), discovery.BackendFly
+	privateIP := os.Getenv(flyPrivateIPKey)
+	if cfg.Mode == ModeStandalone {
+		instance, appName, regionName, backend = randomID(), "", "", discovery.BackendStatic
+		privateIP = ""
+	} else if !env.IsSet() {
 		logger.Error("not running on fly.")
 
 		return nil, errNotOnFly
 	}
 
-	var cfg Config
-	var pGlobal, pLocal, pRelay, pHTTP string
+	var (
+		pGlobal, pLocal, pRelay, pHTTP  string
+		pPrivate, pProbe                string
+		peers, envelope, envelopeWindow string
+		reliable, reliableDeadline      string
+		deliver, fragmentSize, maxSize  string
+		refreshInterval, refreshMax     string
+		staleMax, excludeSelf, selfIP   string
+		latencies, probe                string
+		allowGlobal, denyGlobal         string
+		allowLocal, denyLocal           string
+		allowRelay, denyRelay           string
+	)
 
 	ok := []bool{
-		fetch(&cfg.App, appKey, env.AppName()),
+		fetch(&cfg.Instance, instanceKey, instance) &&
+			required(logger, instanceKey, cfg.Instance != ""),
+
+		fetch(&cfg.App, appKey, appName) &&
+			required(logger, appKey, cfg.App != ""),
+
+		fetch(&cfg.Region, regionKey, regionName) &&
+			required(logger, regionKey, cfg.Region != ""),
 
 		fetch(&pGlobal, globalPortKey, "65535") &&
 			setPort(logger, &cfg.Ports.Global, globalPortKey, pGlobal),
@@ -105,8 +455,101 @@ func Load(logger *zap.Logger) (*Config, error) {
 		fetch(&pRelay, relayPortKey, "65533") &&
 			setPort(logger, &cfg.Ports.Relay, relayPortKey, pRelay),
 
+		fetch(&pProbe, probePortKey, "65532") &&
+			setPort(logger, &cfg.Ports.Probe, probePortKey, pProbe),
+
 		fetch(&pHTTP, httpPortKey, "8080") &&
 			setPort(logger, &cfg.Ports.HTTP, httpPortKey, pHTTP),
+
+		fetch(&pPrivate, privatePortKey, "8081") &&
+			setPort(logger, &cfg.Ports.Private, privatePortKey, pPrivate) &&
+			validPrivatePort(logger, &cfg),
+
+		fetch(&cfg.Discovery.Backend, discoveryKey, backend) &&
+			fetch(&peers, peersKey, "") &&
+			fetch(&cfg.Discovery.DNS, discoveryDNSKey, "") &&
+			fetch(&cfg.Discovery.File, discoveryFileKey, "") &&
+			setDiscovery(logger, &cfg, peers),
+
+		fetch(&envelope, envelopeKey, "false") &&
+			setBool(logger, &cfg.Envelope.Enabled, envelopeKey, envelope),
+
+		fetch(&envelopeWindow, envelopeWindowKey, "10s") &&
+			setDuration(logger, &cfg.Envelope.Window, envelopeWindowKey, envelopeWindow),
+
+		fetch(&reliable, reliableKey, "false") &&
+			setBool(logger, &cfg.Reliable.Enabled, reliableKey, reliable),
+
+		fetch(&reliableDeadline, reliableDeadlineKey, "5s") &&
+			setDuration(logger, &cfg.Reliable.Deadline, reliableDeadlineKey, reliableDeadline),
+
+		fetch(&deliver, deliverKey, "") &&
+			setDestinations(logger, &cfg.Deliver, deliverKey, deliver),
+
+		fetch(&fragmentSize, fragmentSizeKey, "0") &&
+			setSize(logger, &cfg.Fragment.Size, fragmentSizeKey, fragmentSize),
+
+		fetch(&maxSize, maxSizeKey, strconv.Itoa(math.MaxUint16)) &&
+			setMaxSize(logger, &cfg.MaxSize, maxSizeKey, maxSize),
+
+		fetch(&cfg.Truncated.Global, truncatedGlobalKey, TruncatedDrop) &&
+			validTruncation(logger, truncatedGlobalKey, cfg.Truncated.Global),
+
+		fetch(&cfg.Truncated.Local, truncatedLocalKey, TruncatedDrop) &&
+			validTruncation(logger, truncatedLocalKey, cfg.Truncated.Local),
+
+		fetch(&cfg.Bind.Global, bindGlobalKey, BindWildcard) &&
+			validBind(logger, bindGlobalKey, cfg.Bind.Global),
+
+		fetch(&cfg.Bind.Local, bindLocalKey, BindWildcard) &&
+			validBind(logger, bindLocalKey, cfg.Bind.Local),
+
+		fetch(&allowGlobal, allowGlobalKey, "") &&
+			setSources(logger, &cfg.ACL.Global.Allow, allowGlobalKey, allowGlobal) &&
+			fetch(&denyGlobal, denyGlobalKey, "") &&
+			setSources(logger, &cfg.ACL.Global.Deny, denyGlobalKey, denyGlobal),
+
+		fetch(&allowLocal, allowLocalKey, "") &&
+			setSources(logger, &cfg.ACL.Local.Allow, allowLocalKey, allowLocal) &&
+			fetch(&denyLocal, denyLocalKey, "") &&
+			setSources(logger, &cfg.ACL.Local.Deny, denyLocalKey, denyLocal),
+
+		fetch(&allowRelay, allowRelayKey, "") &&
+			setSources(logger, &cfg.ACL.Relay.Allow, allowRelayKey, allowRelay) &&
+			fetch(&denyRelay, denyRelayKey, "") &&
+			setSources(logger, &cfg.ACL.Relay.Deny, denyRelayKey, denyRelay),
+
+		fetch(&refreshInterval, refreshIntervalKey, "1s") &&
+			setDuration(logger, &cfg.Refresh.Interval, refreshIntervalKey, refreshInterval) &&
+			fetch(&refreshMax, refreshMaxKey, refreshInterval) &&
+			setDuration(logger, &cfg.Refresh.Max, refreshMaxKey, refreshMax) &&
+			validRefresh(logger, &cfg),
+
+		fetch(&staleMax, staleMaxKey, "5m") &&
+			setDuration(logger, &cfg.Stale.Max, staleMaxKey, staleMax),
+
+		fetch(&cfg.Stale.Policy, stalePolicyKey, StaleKeep) &&
+			validStalePolicy(logger, cfg.Stale.Policy),
+
+		fetch(&excludeSelf, excludeSelfKey, "false") &&
+			setBool(logger, &cfg.Self.Exclude, excludeSelfKey, excludeSelf),
+
+		fetch(&selfIP, privateIPKey, privateIP) &&
+			setIP(logger, &cfg.Self.PrivateIP, privateIPKey, selfIP),
+
+		fetch(&latencies, latenciesKey, "") &&
+			setLatencies(logger, &cfg.Latency.Static, latenciesKey, latencies),
+
+		fetch(&probe, probeKey, "false") &&
+			setBool(logger, &cfg.Latency.Probe, probeKey, probe),
+
+		setAuth(logger, &cfg),
+
+		setEncrypt(logger, &cfg),
+
+		setRateLimits(logger, &cfg),
+
+		setChannels(logger, &cfg),
 	}
 
 	for _, ok := range ok {
@@ -118,6 +561,93 @@ func Load(logger *zap.Logger) (*Config, error) {
 	return &cfg, nil
 }
 
+func validMode(logger *zap.Logger, mode string) bool {
+	switch mode {
+	case ModeFly, ModeStandalone:
+		return true
+	default:
+		logger.Error("the mode environment variable is invalid.",
+			envVar(modeKey),
+			zap.Strings("valid", []string{
+				ModeFly,
+				ModeStandalone,
+			}))
+
+		return false
+	}
+}
+
+func validPrivatePort(logger *zap.Logger, cfg *Config) bool {
+	if cfg.Ports.Private == cfg.Ports.HTTP {
+		logger.Error("the private port is the same as the http port.",
+			envVar(privatePortKey))
+
+		return false
+	}
+
+	return true
+}
+
+func validRefresh(logger *zap.Logger, cfg *Config) bool {
+	if cfg.Refresh.Max < cfg.Refresh.Interval {
+		logger.Error("the maximum refresh interval is less than the refresh interval.",
+			envVar(refreshMaxKey))
+
+		return false
+	}
+
+	return true
+}
+
+func validTruncation(logger *zap.Logger, key, policy string) bool {
+	switch policy {
+	case TruncatedDrop, TruncatedMark:
+		return true
+	default:
+		logger.Error("a truncation policy environment variable is invalid.",
+			envVar(key),
+			zap.Strings("valid", []string{
+				TruncatedDrop,
+				TruncatedMark,
+			}))
+
+		return false
+	}
+}
+
+func validBind(logger *zap.Logger, key, addr string) bool {
+	switch {
+	case addr == BindWildcard, addr == BindFlyGlobalServices, net.ParseIP(addr) != nil:
+		return true
+	default:
+		logger.Error("a bind address environment variable is invalid.",
+			envVar(key),
+			zap.Strings("valid", []string{
+				BindWildcard,
+				BindFlyGlobalServices,
+				"<ip>",
+			}))
+
+		return false
+	}
+}
+
+func validStalePolicy(logger *zap.Logger, policy string) bool {
+	switch policy {
+	case StaleKeep, StaleClear:
+		return true
+	default:
+		logger.Error("the stale policy environment variable is invalid.",
+			envVar(stalePolicyKey),
+			zap.Strings("valid", []string{
+				StaleKeep,
+				StaleClear,
+			}))
+
+		return false
+	}
+}
+
 func fetch(into *string, key, defVal string) bool {
 	v, found := os.LookupEnv(key)
 	if !found {
@@ -145,6 +675,181 @@ func setPort(logger *zap.Logger, dst *int, key string, value string) (ok bool) {
 	return
 }
 
+func setSize(logger *zap.Logger, dst *int, key string, value string) (ok bool) {
+	switch v, err := strconv.ParseUint(value, 10, 16); {
+	case err != nil, v != 0 && v < fragment.MinSize:
+		logger.Error("a size environment variable is invalid.",
+			envVar(key),
+			zap.Int("min", fragment.MinSize),
+			zap.Int("max", math.MaxUint16))
+	default:
+		ok = true
+
+		*dst = int(v)
+	}
+
+	return
+}
+
+// setMaxSize sets dst to the size, in bytes, beyond which datagrams are
+// considered truncated.
+func setMaxSize(logger *zap.Logger, dst *int, key string, value string) (ok bool) {
+	switch v, err := strconv.ParseUint(value, 10, 16); {
+	case err != nil, v == 0:
+		logger.Error("a size environment variable is invalid.",
+			envVar(key),
+			zap.Int("min", 1),
+			zap.Int("max", math.MaxUint16))
+	default:
+		ok = true
+
+		*dst = int(v)
+	}
+
+	return
+}
+
+func setBool(logger *zap.Logger, dst *bool, key string, value string) (ok bool) {
+	switch v, err := strconv.ParseBool(value); {
+	case err != nil:
+		logger.Error("a boolean environment variable is invalid.",
+			envVar(key))
+	default:
+		ok = true
+
+		*dst = v
+	}
+
+	return
+}
+
+func setIP(logger *zap.Logger, dst *net.IP, key string, value string) (ok bool) {
+	if value == "" {
+		return true // optional
+	}
+
+	switch ip := net.ParseIP(value); ip {
+	case nil:
+		logger.Error("an IP environment variable is invalid.",
+			envVar(key))
+	default:
+		ok = true
+
+		*dst = ip
+	}
+
+	return
+}
+
+// setLatencies parses a comma separated list of region=duration pairs.
+func setLatencies(logger *zap.Logger, dst *map[string]time.Duration, key string, value string) bool {
+	m := make(map[string]time.Duration)
+	for _, tok := range splitList(value) {
+		region, rtt, _ := strings.Cut(tok, "=")
+
+		d, err := time.ParseDuration(strings.TrimSpace(rtt))
+		if region = strings.TrimSpace(region); region == "" || err != nil || d < 0 {
+			logger.Error("a latency environment variable is invalid.",
+				envVar(key),
+				zap.String("entry", tok))
+
+			return false
+		}
+		m[region] = d
+	}
+	*dst = m
+
+	return true
+}
+
+func setDuration(logger *zap.Logger, dst *time.Duration, key string, value string) (ok bool) {
+	switch v, err := time.ParseDuration(value); {
+	case err != nil, v <= 0:
+		logger.Error("a duration environment variable is invalid.",
+			envVar(key))
+	default:
+		ok = true
+
+		*dst = v
+	}
+
+	return
+}
+
+func setDestinations(logger *zap.Logger, dst *[]Destination, key string, value string) bool {
+	for _, tok := range strings.Split(value, ",") {
+		if tok = strings.TrimSpace(tok); tok == "" {
+			continue
+		}
+
+		d, err := ParseDestination(tok)
+		if err != nil {
+			logger.Error("a destination environment variable is invalid.",
+				envVar(key),
+				zap.Error(err))
+
+			return false
+		}
+
+		*dst = append(*dst, d)
+	}
+
+	return true
+}
+
+func setDiscovery(logger *zap.Logger, cfg *Config, peers string) (ok bool) {
+	var err error
+	if cfg.Discovery.Peers, err = discovery.ParseList(peers); err != nil {
+		logger.Error("the peers environment variable is invalid.",
+			envVar(peersKey),
+			zap.Error(err))
+
+		return
+	}
+
+	switch d := &cfg.Discovery; d.Backend {
+	default:
+		logger.Error("the discovery environment variable is invalid.",
+			envVar(discoveryKey),
+			zap.Strings("valid", []string{
+				discovery.BackendFly,
+				discovery.BackendStatic,
+				discovery.BackendDNS,
+				discovery.BackendFile,
+			}))
+	case discovery.BackendFly:
+		if ok = cfg.Mode == ModeFly; !ok {
+			logger.Error("the fly discovery backend is only available on fly.",
+				envVar(discoveryKey),
+				envVar(modeKey))
+		}
+	case discovery.BackendStatic:
+		ok = required(logger, peersKey, len(d.Peers) > 0)
+	case discovery.BackendDNS:
+		ok = required(logger, discoveryDNSKey, d.DNS != "")
+	case discovery.BackendFile:
+		ok = required(logger, discoveryFileKey, d.File != "")
+	}
+
+	return
+}
+
+func required(logger *zap.Logger, key string, set bool) bool {
+	if !set {
+		logger.Error("a required environment variable is not set.",
+			envVar(key))
+	}
+
+	return set
+}
+
+func randomID() string {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+
+	return hex.EncodeToString(id[:])
+}
+
 func envVar(key string) zap.Field {
 	return zap.String("var", "$"+key)
 }
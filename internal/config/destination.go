@@ -0,0 +1,66 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// The set of networks a Destination may refer to.
+const (
+	// NetworkUDP denotes UDP destinations.
+	NetworkUDP = "udp"
+
+	// NetworkUnixgram denotes Unix datagram socket destinations.
+	NetworkUnixgram = "unixgram"
+)
+
+// Destination denotes a local destination relayed packets are delivered to.
+type Destination struct {
+	// Network holds the network of the Destination, either NetworkUDP or
+	// NetworkUnixgram.
+	Network string
+
+	// Addr holds the address (for UDP) or path (for Unix datagram sockets) of
+	// the Destination.
+	Addr string
+}
+
+// String implements fmt.Stringer for Destination.
+func (d Destination) String() string {
+	if d.Network == NetworkUnixgram {
+		return "unix://" + d.Addr
+	}
+
+	return "udp://" + d.Addr
+}
+
+// ParseDestination parses a Destination from its textual representation,
+// which takes the form of either [udp://]host:port or unix:///path.
+func ParseDestination(s string) (d Destination, err error) {
+	switch {
+	case strings.HasPrefix(s, "unix://"):
+		d.Network, d.Addr = NetworkUnixgram, strings.TrimPrefix(s, "unix://")
+		if d.Addr == "" {
+			err = fmt.Errorf("invalid destination %q: %w", s, errNoPath)
+		}
+	default:
+		d.Network, d.Addr = NetworkUDP, strings.TrimPrefix(s, "udp://")
+
+		var addr *net.UDPAddr
+		switch addr, err = net.ResolveUDPAddr(NetworkUDP, d.Addr); {
+		case err != nil:
+			err = fmt.Errorf("invalid destination %q: %w", s, err)
+		case addr.Port == 0:
+			err = fmt.Errorf("invalid destination %q: %w", s, errNoPort)
+		}
+	}
+
+	return
+}
+
+var (
+	errNoPath = errors.New("missing path")
+	errNoPort = errors.New("missing port")
+)
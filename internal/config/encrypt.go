@@ -0,0 +1,51 @@
+package config
+
+import (
+	"go.uber.org/zap"
+)
+
+const (
+	encryptKey     = "ENCRYPT"
+	encryptKeysKey = "ENCRYPT_KEYS"
+	encryptKeyKey  = "ENCRYPT_KEY"
+)
+
+// Encrypt wraps the encryption configuration.
+type Encrypt struct {
+	// Enabled holds the value of the ENCRYPT environment variable.
+	Enabled bool
+
+	// Keys holds the parsed value of the ENCRYPT_KEYS environment variable,
+	// keyed by ID.
+	Keys map[uint8][]byte
+
+	// Key holds the parsed value of the ENCRYPT_KEY environment variable.
+	Key uint8
+}
+
+// setEncrypt sets the encryption configuration of cfg. The keys are only
+// required when encryption is enabled, and the key packets are encrypted with
+// defaults to the first one listed.
+func setEncrypt(logger *zap.Logger, cfg *Config) bool {
+	var enabled, keys string
+
+	ok := fetch(&enabled, encryptKey, "false") &&
+		setBool(logger, &cfg.Encrypt.Enabled, encryptKey, enabled) &&
+		fetch(&keys, encryptKeysKey, "") &&
+		required(logger, encryptKeysKey, keys != "" || !cfg.Encrypt.Enabled)
+	if !ok || keys == "" {
+		return ok
+	}
+
+	return setKeys(logger, &cfg.Encrypt.Keys, &cfg.Encrypt.Key, encryptKeysKey, encryptKeyKey, keys, validEncryptKey)
+}
+
+// validEncryptKey reports whether b is an AES-128, AES-192 or AES-256 key.
+func validEncryptKey(b []byte) bool {
+	switch len(b) {
+	case 16, 24, 32:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// setKeys parses the given comma separated list of id=secret keys, the
+// secrets of which are base64 encoded, into dst and sets cur to the ID the
+// environment variable named curKey holds, defaulting to the first key listed.
+func setKeys(logger *zap.Logger, dst *map[uint8][]byte, cur *uint8, listKey, curKey, value string, valid func([]byte) bool) bool {
+	keys := make(map[uint8][]byte)
+
+	var first uint8
+	for i, tok := range splitList(value) {
+		id, secret, _ := strings.Cut(tok, "=")
+
+		n, err := strconv.ParseUint(strings.TrimSpace(id), 10, 8)
+		if err != nil {
+			logger.Error("a key ID is invalid.",
+				envVar(listKey),
+				zap.Int("index", i))
+
+			return false
+		}
+
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secret))
+		if _, dup := keys[uint8(n)]; dup || err != nil || !valid(b) {
+			logger.Error("a key is invalid, of invalid size or duplicate.",
+				envVar(listKey),
+				zap.Uint64("id", n))
+
+			return false
+		}
+
+		if len(keys) == 0 {
+			first = uint8(n)
+		}
+		keys[uint8(n)] = b
+	}
+	*dst = keys
+
+	var id string
+	if !fetch(&id, curKey, strconv.Itoa(int(first))) {
+		return false
+	}
+
+	n, err := strconv.ParseUint(id, 10, 8)
+	if _, known := keys[uint8(n)]; err != nil || !known {
+		logger.Error("a key ID environment variable names no known key.",
+			envVar(curKey))
+
+		return false
+	}
+	*cur = uint8(n)
+
+	return true
+}
+
+// keyIDs returns the sorted IDs of the given keys.
+func keyIDs(keys map[uint8][]byte) []int {
+	ids := make([]int, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	return ids
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSetKeys(t *testing.T) {
+	const (
+		listKey = "TEST_KEYS"
+		curKey  = "TEST_KEY"
+	)
+
+	var (
+		k1 = bytes.Repeat([]byte{1}, 16)
+		k2 = bytes.Repeat([]byte{2}, 32)
+
+		b1 = base64.StdEncoding.EncodeToString(k1)
+		b2 = base64.StdEncoding.EncodeToString(k2)
+	)
+
+	valid := func(b []byte) bool {
+		return len(b) >= 16
+	}
+
+	cases := []struct {
+		name  string
+		value string
+		cur   string // unset when empty
+
+		expected    map[uint8][]byte
+		expectedCur uint8
+		invalid     bool
+	}{
+		{
+			name:        "single",
+			value:       "7=" + b1,
+			expected:    map[uint8][]byte{7: k1},
+			expectedCur: 7,
+		},
+		{
+			name:        "defaults to the first",
+			value:       "9=" + b2 + ", 3=" + b1,
+			expected:    map[uint8][]byte{3: k1, 9: k2},
+			expectedCur: 9,
+		},
+		{
+			name:        "current set",
+			value:       "9=" + b2 + ",3=" + b1,
+			cur:         "3",
+			expected:    map[uint8][]byte{3: k1, 9: k2},
+			expectedCur: 3,
+		},
+		{
+			name:  "current unknown",
+			value: "9=" + b2,
+			cur:   "3",
+			// the keys are set regardless
+			expected: map[uint8][]byte{9: k2},
+			invalid:  true,
+		},
+		{
+			name:    "current not an ID",
+			value:   "9=" + b2,
+			cur:     "nine",
+			invalid: true,
+		},
+		{
+			name:    "none",
+			value:   "",
+			invalid: true,
+		},
+		{
+			name:    "ID out of range",
+			value:   "256=" + b1,
+			invalid: true,
+		},
+		{
+			name:    "ID missing",
+			value:   b1,
+			invalid: true,
+		},
+		{
+			name:    "secret not base64",
+			value:   "1=not base64!",
+			invalid: true,
+		},
+		{
+			name:    "secret too short",
+			value:   "1=" + base64.StdEncoding.EncodeToString([]byte("short")),
+			invalid: true,
+		},
+		{
+			name:    "duplicate ID",
+			value:   "1=" + b1 + ",1=" + b2,
+			invalid: true,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			if c.cur != "" {
+				t.Setenv(curKey, c.cur)
+			}
+
+			var (
+				keys map[uint8][]byte
+				cur  uint8
+			)
+			ok := setKeys(zap.NewNop(), &keys, &cur, listKey, curKey, c.value, valid)
+
+			if ok == c.invalid {
+				t.Fatalf("expected %t, got %t", !c.invalid, ok)
+			}
+			if c.invalid && c.expected == nil {
+				return
+			}
+
+			if len(keys) != len(c.expected) {
+				t.Fatalf("expected %d keys, got %d", len(c.expected), len(keys))
+			}
+			for id, k := range c.expected {
+				if !bytes.Equal(keys[id], k) {
+					t.Errorf("expected key %d to be %x, got %x", id, k, keys[id])
+				}
+			}
+			if !c.invalid && cur != c.expectedCur {
+				t.Errorf("expected the current key to be %d, got %d", c.expectedCur, cur)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The prefixes of the sets of rate limit environment variables, which the
+// rate suffixes follow.
+const (
+	ratePrefix      = "RATE_" // also of the CHANNEL_n_RATE_* ones
+	rateRelayPrefix = "RATE_RELAY_"
+)
+
+const (
+	rateSourcePacketsSuffix = "SOURCE_PACKETS"
+	rateSourceBytesSuffix   = "SOURCE_BYTES"
+	ratePortPacketsSuffix   = "PORT_PACKETS"
+	ratePortBytesSuffix     = "PORT_BYTES"
+	rateBurstSuffix         = "BURST"
+)
+
+// Rate wraps the rate limits of a listening port. Zero rates denote no limit.
+//
+// The limits of the ports of the legacy channels are set via the RATE_*
+// environment variables, which the CHANNEL_n_RATE_* ones default to. Those
+// of the relay port are set via the RATE_RELAY_* ones.
+type Rate struct {
+	// SourcePackets holds the value of the RATE_SOURCE_PACKETS environment
+	// variable.
+	SourcePackets float64
+
+	// SourceBytes holds the value of the RATE_SOURCE_BYTES environment
+	// variable.
+	SourceBytes float64
+
+	// PortPackets holds the value of the RATE_PORT_PACKETS environment
+	// variable.
+	PortPackets float64
+
+	// PortBytes holds the value of the RATE_PORT_BYTES environment variable.
+	PortBytes float64
+
+	// Burst holds the value of the RATE_BURST environment variable.
+	Burst time.Duration
+}
+
+// String implements fmt.Stringer for Rate.
+func (r *Rate) String() string {
+	return fmt.Sprintf("source=%gpps,%gBps port=%gpps,%gBps burst=%s",
+		r.SourcePackets, r.SourceBytes, r.PortPackets, r.PortBytes, r.Burst)
+}
+
+// Limited reports whether any of the rates of r is limited.
+func (r *Rate) Limited() bool {
+	return r.SourcePackets > 0 || r.SourceBytes > 0 || r.PortPackets > 0 || r.PortBytes > 0
+}
+
+func setRateLimits(logger *zap.Logger, cfg *Config) bool {
+	return setRates(logger, &cfg.Rate, ratePrefix, Rate{Burst: time.Second}) &&
+		setRates(logger, &cfg.RelayRate, rateRelayPrefix, Rate{Burst: cfg.Rate.Burst})
+}
+
+// setRates sets dst to the limits the environment variables which start with
+// prefix hold, each of which defaults to the respective limit of def.
+func setRates(logger *zap.Logger, dst *Rate, prefix string, def Rate) bool {
+	var (
+		sourcePacketsKey = prefix + rateSourcePacketsSuffix
+		sourceBytesKey   = prefix + rateSourceBytesSuffix
+		portPacketsKey   = prefix + ratePortPacketsSuffix
+		portBytesKey     = prefix + ratePortBytesSuffix
+		burstKey         = prefix + rateBurstSuffix
+
+		sourcePackets, sourceBytes, portPackets, portBytes, burst string
+	)
+
+	return fetch(&sourcePackets, sourcePacketsKey, formatRate(def.SourcePackets)) &&
+		setRate(logger, &dst.SourcePackets, sourcePacketsKey, sourcePackets) &&
+		fetch(&sourceBytes, sourceBytesKey, formatRate(def.SourceBytes)) &&
+		setRate(logger, &dst.SourceBytes, sourceBytesKey, sourceBytes) &&
+		fetch(&portPackets, portPacketsKey, formatRate(def.PortPackets)) &&
+		setRate(logger, &dst.PortPackets, portPacketsKey, portPackets) &&
+		fetch(&portBytes, portBytesKey, formatRate(def.PortBytes)) &&
+		setRate(logger, &dst.PortBytes, portBytesKey, portBytes) &&
+		fetch(&burst, burstKey, def.Burst.String()) &&
+		setDuration(logger, &dst.Burst, burstKey, burst)
+}
+
+func formatRate(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// setRate sets dst to the given rate, which must be a finite, non-negative
+// number.
+func setRate(logger *zap.Logger, dst *float64, key string, value string) (ok bool) {
+	switch v, err := strconv.ParseFloat(value, 64); {
+	case err != nil, math.IsNaN(v), math.IsInf(v, 0), v < 0:
+		logger.Error("a rate environment variable is invalid.",
+			envVar(key))
+	default:
+		ok = true
+
+		*dst = v
+	}
+
+	return
+}
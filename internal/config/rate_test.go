@@ -0,0 +1,42 @@
+package config
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSetRate(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected float64
+		invalid  bool
+	}{
+		{value: "0", expected: 0},
+		{value: "100", expected: 100},
+		{value: "2.5", expected: 2.5},
+		{value: "1e3", expected: 1000},
+		{value: "-1", invalid: true},
+		{value: "NaN", invalid: true},
+		{value: "nan", invalid: true},
+		{value: "Inf", invalid: true},
+		{value: "+Inf", invalid: true},
+		{value: "-Inf", invalid: true},
+		{value: "1e400", invalid: true}, // out of range
+		{value: "fast", invalid: true},
+		{value: "", invalid: true},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.value, func(t *testing.T) {
+			var got float64
+			if ok := setRate(zap.NewNop(), &got, "TEST_RATE", c.value); ok == c.invalid {
+				t.Fatalf("expected valid to be %t", !c.invalid)
+			}
+			if !c.invalid && got != c.expected {
+				t.Errorf("expected %g, got %g", c.expected, got)
+			}
+		})
+	}
+}
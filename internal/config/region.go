@@ -0,0 +1,101 @@
+package config
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// regionGroups holds the built-in region groups, keyed by name.
+var regionGroups = map[string][]string{
+	"africa":        {"jnb"},
+	"asia-pacific":  {"bom", "hkg", "nrt", "sin", "syd"},
+	"europe":        {"ams", "arn", "cdg", "fra", "lhr", "mad", "otp", "waw"},
+	"north-america": {"atl", "bos", "den", "dfw", "ewr", "gdl", "iad", "lax", "mia", "ord", "phx", "qro", "sea", "sjc", "yul", "yyz"},
+	"south-america": {"bog", "eze", "gig", "gru", "scl"},
+}
+
+// regionGroupPrefix prefixes the environment variables which define (or
+// redefine) region groups.
+const regionGroupPrefix = "REGION_GROUP_"
+
+// loadRegionGroups returns the built-in region groups along with those the
+// REGION_GROUP_<NAME> environment variables define. Group names are lower
+// cased, with underscores replaced by dashes.
+func loadRegionGroups(logger *zap.Logger) (groups map[string][]string, ok bool) {
+	groups = make(map[string][]string, len(regionGroups))
+	for name, regions := range regionGroups {
+		groups[name] = regions
+	}
+
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, regionGroupPrefix) {
+			continue
+		}
+		key, value, _ := strings.Cut(kv, "=")
+
+		name := strings.TrimPrefix(key, regionGroupPrefix)
+		name = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+
+		regions := splitList(value)
+		if name == "" || len(regions) == 0 {
+			logger.Error("a region group environment variable is invalid.",
+				envVar(key))
+
+			return nil, false
+		}
+		groups[name] = regions
+	}
+
+	return groups, true
+}
+
+// regionGroupNames returns the sorted names of the given groups.
+func regionGroupNames(groups map[string][]string) []string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// expandRegions returns the distinct regions the given comma separated list
+// of regions, region groups and the local alias denotes.
+func expandRegions(list, local string, groups map[string][]string) (regions []string) {
+	seen := make(map[string]struct{})
+	add := func(r string) {
+		if _, dup := seen[r]; !dup {
+			seen[r] = struct{}{}
+			regions = append(regions, r)
+		}
+	}
+
+	for _, tok := range splitList(list) {
+		switch group, isGroup := groups[tok]; {
+		case isGroup:
+			for _, r := range group {
+				add(r)
+			}
+		case tok == ScopeLocal:
+			add(local)
+		default:
+			add(tok)
+		}
+	}
+
+	return
+}
+
+func splitList(value string) (ret []string) {
+	for _, tok := range strings.Split(value, ",") {
+		if tok = strings.TrimSpace(tok); tok != "" {
+			ret = append(ret, tok)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Source denotes a set of source addresses; either a network or the addresses
+// a host name resolves to.
+type Source struct {
+	// Net holds the network of the Source, or nil for host names.
+	Net *net.IPNet
+
+	// Host holds the host name of the Source (i.e. my-app.internal), or the
+	// empty string for networks.
+	Host string
+}
+
+// String implements fmt.Stringer for Source.
+func (s Source) String() string {
+	if s.Net != nil {
+		return s.Net.String()
+	}
+
+	return s.Host
+}
+
+// ParseSource parses a Source from its textual representation, which takes
+// the form of a CIDR network (i.e. fdaa::/16), an IP address or a host name.
+func ParseSource(s string) (src Source, err error) {
+	if strings.Contains(s, "/") {
+		if _, src.Net, err = net.ParseCIDR(s); err != nil {
+			err = fmt.Errorf("invalid source %q: %w", s, err)
+		}
+
+		return
+	}
+
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		src.Net = &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(bits, bits),
+		}
+
+		return
+	}
+
+	if !validHost(s) {
+		return src, fmt.Errorf("invalid source %q: %w", s, errInvalidHost)
+	}
+	src.Host = s
+
+	return
+}
+
+func validHost(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			continue
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+var errInvalidHost = errors.New("invalid host name")
+
+// ACL wraps the source address rules of a listening port.
+type ACL struct {
+	// Allow holds the sources the port accepts packets from, or nil for all
+	// sources.
+	Allow []Source
+
+	// Deny holds the sources the port drops packets from, even if allowed.
+	Deny []Source
+}
+
+// IsZero reports whether acl accepts all sources.
+func (acl *ACL) IsZero() bool {
+	return len(acl.Allow) == 0 && len(acl.Deny) == 0
+}
+
+// String implements fmt.Stringer for ACL.
+func (acl *ACL) String() string {
+	allow := sources(acl.Allow)
+	if allow == "" {
+		allow = "*"
+	}
+
+	return fmt.Sprintf("allow=%s deny=%s", allow, sources(acl.Deny))
+}
+
+func sources(srcs []Source) string {
+	s := make([]string, 0, len(srcs))
+	for _, src := range srcs {
+		s = append(s, src.String())
+	}
+
+	return strings.Join(s, ",")
+}
+
+func setSources(logger *zap.Logger, dst *[]Source, key string, value string) bool {
+	for _, tok := range splitList(value) {
+		src, err := ParseSource(tok)
+		if err != nil {
+			logger.Error("a source environment variable is invalid.",
+				envVar(key),
+				zap.Error(err))
+
+			return false
+		}
+
+		*dst = append(*dst, src)
+	}
+
+	return true
+}
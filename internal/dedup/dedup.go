@@ -0,0 +1,57 @@
+// Package dedup implements time windowed duplicate detection.
+package dedup
+
+import (
+	"sync"
+	"time"
+)
+
+// Window remembers the keys it admits for at least its duration.
+//
+// The keys are kept in two generations, each spanning the duration of the
+// Window; the older generation is dropped as soon as the current one exceeds
+// it.
+type Window[K comparable] struct {
+	dur time.Duration
+
+	mu      sync.Mutex
+	rotated time.Time
+	cur     map[K]struct{}
+	prev    map[K]struct{}
+}
+
+// New returns a Window of the given duration.
+func New[K comparable](dur time.Duration) *Window[K] {
+	return &Window[K]{
+		dur:     dur,
+		rotated: time.Now(),
+		cur:     make(map[K]struct{}),
+	}
+}
+
+// Admit reports whether k has not been seen within the Window and remembers it.
+func (w *Window[K]) Admit(k K) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	switch elapsed := now.Sub(w.rotated); {
+	case elapsed >= w.dur<<1:
+		w.prev, w.cur = nil, make(map[K]struct{})
+		w.rotated = now
+	case elapsed >= w.dur:
+		w.prev, w.cur = w.cur, make(map[K]struct{}, len(w.cur))
+		w.rotated = now
+	}
+
+	if _, seen := w.cur[k]; seen {
+		return false
+	}
+	if _, seen := w.prev[k]; seen {
+		return false
+	}
+
+	w.cur[k] = struct{}{}
+
+	return true
+}
@@ -0,0 +1,156 @@
+// Package discovery implements the backends via which peers are discovered.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The set of supported backends.
+const (
+	// BackendFly denotes the backend which discovers instances via Fly's
+	// internal DNS.
+	BackendFly = "fly"
+
+	// BackendStatic denotes the backend which discovers instances from a
+	// static list.
+	BackendStatic = "static"
+
+	// BackendDNS denotes the backend which discovers instances via generic
+	// A/AAAA or SRV DNS lookups.
+	BackendDNS = "dns"
+
+	// BackendFile denotes the backend which discovers instances from a file
+	// it polls.
+	BackendFile = "file"
+)
+
+// Discoverer is the interface peer discovery backends implement.
+type Discoverer interface {
+	// Discover returns the instances running in the given region.
+	//
+	// An empty region denotes all of the regions.
+	Discover(ctx context.Context, region string) ([]Instance, error)
+}
+
+// RegionLister is the interface the Discoverers which may list the regions
+// instances run in, without resolving them, implement.
+type RegionLister interface {
+	// Regions returns the regions instances run in.
+	Regions(ctx context.Context) ([]string, error)
+}
+
+// TTLDiscoverer is the interface the Discoverers which know for how long the
+// instances they discover remain valid implement.
+type TTLDiscoverer interface {
+	Discoverer
+
+	// DiscoverTTL is like Discover, but also returns the TTL of the records
+	// the instances were discovered by, or zero in case it is unknown.
+	DiscoverTTL(ctx context.Context, region string) ([]Instance, time.Duration, error)
+}
+
+// Instance denotes a discovered instance.
+type Instance struct {
+	// IP holds the address of the instance.
+	IP net.IP
+
+	// Port holds the port of the instance. Zero denotes the default port.
+	Port int
+
+	// Region holds the region of the instance, if known.
+	Region string
+}
+
+// String implements fmt.Stringer for Instance.
+func (inst Instance) String() (s string) {
+	if s = inst.IP.String(); inst.Port != 0 {
+		s = net.JoinHostPort(s, strconv.Itoa(inst.Port))
+	}
+
+	if inst.Region != "" {
+		s = inst.Region + "/" + s
+	}
+
+	return
+}
+
+// Parse parses an Instance from its textual representation, which takes the
+// form of [region/]ip[:port].
+func Parse(s string) (inst Instance, err error) {
+	orig := s
+	if i := strings.IndexByte(s, '/'); i != -1 {
+		inst.Region, s = s[:i], s[i+1:]
+	}
+
+	if inst.IP = net.ParseIP(s); inst.IP != nil {
+		return
+	}
+
+	var host, port string
+	if host, port, err = net.SplitHostPort(s); err != nil {
+		return inst, fmt.Errorf("invalid instance %q: %w", orig, err)
+	}
+
+	if inst.IP = net.ParseIP(host); inst.IP == nil {
+		return inst, fmt.Errorf("invalid instance %q: %w", orig, errInvalidIP)
+	}
+
+	switch p, perr := strconv.ParseUint(port, 10, 16); {
+	case perr != nil, p == 0:
+		return inst, fmt.Errorf("invalid instance %q: %w", orig, errInvalidPort)
+	default:
+		inst.Port = int(p)
+	}
+
+	return
+}
+
+// ParseList parses the comma separated list of instances s contains.
+func ParseList(s string) (insts []Instance, err error) {
+	for _, tok := range strings.Split(s, ",") {
+		if tok = strings.TrimSpace(tok); tok == "" {
+			continue
+		}
+
+		var inst Instance
+		if inst, err = Parse(tok); err != nil {
+			return nil, err
+		}
+
+		insts = append(insts, inst)
+	}
+
+	return
+}
+
+var (
+	errInvalidIP   = errors.New("invalid ip")
+	errInvalidPort = errors.New("invalid port")
+)
+
+// filter returns the subset of insts which run in the given region.
+func filter(insts []Instance, region string) []Instance {
+	if region == "" {
+		return insts
+	}
+
+	var ret []Instance
+	for _, inst := range insts {
+		if inst.Region == region {
+			ret = append(ret, inst)
+		}
+	}
+
+	return ret
+}
+
+func isNXDomain(err error) bool {
+	var w *net.DNSError
+	return errors.As(err, &w) && w.IsNotFound
+}
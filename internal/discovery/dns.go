@@ -0,0 +1,70 @@
+package discovery
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// RegionPlaceholder is the token which, when present in the name a DNS
+// Discoverer looks up, is replaced by the region being discovered (or global).
+const RegionPlaceholder = "{region}"
+
+// NewDNS returns a Discoverer which discovers instances by looking up the
+// given name.
+//
+// Names the first label of which starts with an underscore (i.e.
+// _flycast._udp.example.com) are looked up as SRV records, while all others as
+// A/AAAA records. Names are looked up directly against the name servers of the
+// system, with its search domains and hosts file applying as they otherwise
+// would.
+//
+// The returned Discoverer implements TTLDiscoverer.
+func NewDNS(name string) Discoverer {
+	return &dnsDiscoverer{
+		name: name,
+		r:    newResolver(),
+	}
+}
+
+type dnsDiscoverer struct {
+	name string
+	r    *resolver
+}
+
+func (d *dnsDiscoverer) Discover(ctx context.Context, region string) ([]Instance, error) {
+	insts, _, err := d.DiscoverTTL(ctx, region)
+
+	return insts, err
+}
+
+func (d *dnsDiscoverer) DiscoverTTL(ctx context.Context, region string) (insts []Instance, ttl time.Duration, err error) {
+	host := d.host(region)
+
+	if strings.HasPrefix(host, "_") {
+		insts, ttl, err = d.r.lookupSRV(ctx, host)
+	} else {
+		insts, ttl, err = d.r.lookupIP(ctx, host, 0)
+	}
+
+	switch {
+	case isNXDomain(err):
+		return nil, ttl, nil
+	case err != nil:
+		return nil, 0, err
+	}
+
+	for i := range insts {
+		insts[i].Region = region
+	}
+
+	return
+}
+
+func (d *dnsDiscoverer) host(region string) string {
+	if region == "" {
+		region = "global"
+	}
+
+	return strings.ReplaceAll(d.name, RegionPlaceholder, region)
+}
@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewFile returns a Discoverer which discovers the instances listed in the
+// file at the given path.
+//
+// The file lists one or more instances per line, in the format Parse and
+// ParseList accept. Empty lines and text following a # are ignored.
+//
+// The file is not watched; it is polled instead. Each call to Discover, and
+// therefore each refresh of the peer lists, stats the file and re-reads it
+// whenever its modification time or size differ from the ones observed when it
+// was last read. Changes are thus picked up within a refresh interval, unless
+// they preserve both.
+func NewFile(path string) Discoverer {
+	return &fileDiscoverer{
+		path: path,
+	}
+}
+
+type fileDiscoverer struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	insts   []Instance
+}
+
+func (fd *fileDiscoverer) Discover(_ context.Context, region string) ([]Instance, error) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	if err := fd.load(); err != nil {
+		return nil, err
+	}
+
+	return filter(fd.insts, region), nil
+}
+
+func (fd *fileDiscoverer) load() error {
+	fi, err := os.Stat(fd.path)
+	if err != nil {
+		return err
+	}
+
+	if fi.ModTime().Equal(fd.modTime) && fi.Size() == fd.size {
+		return nil // unchanged
+	}
+
+	data, err := os.ReadFile(fd.path)
+	if err != nil {
+		return err
+	}
+
+	var insts []Instance
+	for i, line := range strings.Split(string(data), "\n") {
+		if n := strings.IndexByte(line, '#'); n != -1 {
+			line = line[:n]
+		}
+
+		parsed, err := ParseList(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", fd.path, i+1, err)
+		}
+
+		insts = append(insts, parsed...)
+	}
+
+	fd.modTime, fd.size, fd.insts = fi.ModTime(), fi.Size(), insts
+
+	return nil
+}
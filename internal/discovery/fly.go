@@ -0,0 +1,60 @@
+package discovery
+
+import (
+	"context"
+	"time"
+
+	"github.com/azazeal/fly/dns"
+)
+
+// NewFly returns a Discoverer which discovers the instances of the given app
+// via Fly's internal DNS, by looking up the AAAA records of
+// <region>.<app>.internal.
+//
+// The returned Discoverer implements RegionLister and TTLDiscoverer.
+func NewFly(app string) Discoverer {
+	return &flyDiscoverer{
+		app: app,
+		r:   newResolver(),
+	}
+}
+
+type flyDiscoverer struct {
+	app string
+	r   *resolver
+}
+
+func (d *flyDiscoverer) Discover(ctx context.Context, region string) ([]Instance, error) {
+	insts, _, err := d.DiscoverTTL(ctx, region)
+
+	return insts, err
+}
+
+func (d *flyDiscoverer) DiscoverTTL(ctx context.Context, region string) ([]Instance, time.Duration, error) {
+	host := region
+	if host == "" {
+		host = "global"
+	}
+
+	switch insts, ttl, err := d.r.lookupIPv6(ctx, host+"."+d.app+".internal", 0); {
+	default:
+		return nil, 0, err
+	case isNXDomain(err):
+		return nil, ttl, nil
+	case err == nil:
+		for i := range insts {
+			insts[i].Region = region
+		}
+
+		return insts, ttl, nil
+	}
+}
+
+func (d *flyDiscoverer) Regions(ctx context.Context) ([]string, error) {
+	switch regions, err := dns.Regions(ctx, d.app); {
+	case isNXDomain(err):
+		return nil, nil
+	default:
+		return regions, err
+	}
+}
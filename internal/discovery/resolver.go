@@ -0,0 +1,527 @@
+package discovery
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// resolvConf denotes the file the name servers, the search domains and
+	// the ndots option are read from.
+	resolvConf = "/etc/resolv.conf"
+
+	// hostsFile denotes the file static host names are read from.
+	hostsFile = "/etc/hosts"
+
+	// defaultNdots denotes the value of the ndots option resolv.conf files
+	// which do not set it default to.
+	defaultNdots = 1
+
+	// queryTimeout denotes the timeout of each query to a name server.
+	queryTimeout = 5 * time.Second
+
+	// maxUDPSize denotes the size of the largest UDP response accepted.
+	maxUDPSize = 4096
+)
+
+var errMismatch = errors.New("mismatched response")
+
+// resolver looks up A, AAAA and SRV records along with their TTLs, which
+// net.Resolver does not expose, by querying the name servers directly.
+//
+// Like the resolver of the system, it looks up names which are not fully
+// qualified under each of the search domains, and the addresses of the host
+// names the hosts file lists (which have no TTL) in the hosts file.
+type resolver struct {
+	servers []string // host:port
+	search  []string // fully qualified
+	ndots   int      // names with fewer dots are tried as is last
+	hosts   string   // the path to the hosts file, if any
+}
+
+// newResolver returns a resolver which queries the name servers of the
+// system, or those of the local host in case there are none.
+func newResolver() *resolver {
+	r := readResolvConf(resolvConf)
+	if len(r.servers) == 0 {
+		r.servers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+	r.hosts = hostsFile
+
+	return r
+}
+
+// readResolvConf returns a resolver which queries the name servers, and
+// applies the search domains and the ndots option, the given resolv.conf file
+// lists.
+func readResolvConf(path string) *resolver {
+	r := &resolver{
+		ndots: defaultNdots,
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return r
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+
+		switch f[0] {
+		case "nameserver":
+			r.servers = append(r.servers, net.JoinHostPort(f[1], "53"))
+		case "domain", "search":
+			// the last of them applies
+			r.search = r.search[:0]
+			for _, domain := range f[1:] {
+				r.search = append(r.search, strings.TrimSuffix(domain, ".")+".")
+			}
+		case "options":
+			for _, opt := range f[1:] {
+				if v, ok := cutPrefix(opt, "ndots:"); ok {
+					if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+						r.ndots = n
+					}
+				}
+			}
+		}
+	}
+
+	return r
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+
+	return s[len(prefix):], true
+}
+
+// names returns the fully qualified names host is looked up as, in order.
+// Names with at least as many dots as the ndots option of r are tried as is
+// first, while all others last.
+func (r *resolver) names(host string) []string {
+	if strings.HasSuffix(host, ".") {
+		return []string{host}
+	}
+
+	names := make([]string, 0, 1+len(r.search))
+	for _, domain := range r.search {
+		names = append(names, host+"."+domain)
+	}
+
+	if strings.Count(host, ".") >= r.ndots {
+		return append([]string{host + "."}, names...)
+	}
+
+	return append(names, host+".")
+}
+
+// lookupIP returns the instances the A and AAAA records of host denote, with
+// the given port, along with the TTL of the records.
+func (r *resolver) lookupIP(ctx context.Context, host string, port int) ([]Instance, time.Duration, error) {
+	return r.lookupAddrs(ctx, host, port, dnsmessage.TypeA, dnsmessage.TypeAAAA)
+}
+
+// lookupIPv6 is like lookupIP, but looks up AAAA records only.
+func (r *resolver) lookupIPv6(ctx context.Context, host string, port int) ([]Instance, time.Duration, error) {
+	return r.lookupAddrs(ctx, host, port, dnsmessage.TypeAAAA)
+}
+
+// lookupAddrs returns the instances the records of the given types (A or
+// AAAA) of host denote, with the given port, along with the TTL of the
+// records. The hosts file is consulted first.
+func (r *resolver) lookupAddrs(ctx context.Context, host string, port int, types ...dnsmessage.Type) (insts []Instance, ttl time.Duration, err error) {
+	if insts = r.lookupHosts(host, port, types); len(insts) > 0 {
+		return insts, 0, nil
+	}
+
+	for _, name := range r.names(host) {
+		if insts, ttl, err = r.queryAddrs(ctx, name, port, types); conclusive(insts, err) {
+			break
+		}
+	}
+
+	return
+}
+
+// queryAddrs returns the instances the records of the given types of the
+// fully qualified name denote, with the given port, along with the TTL of the
+// records.
+func (r *resolver) queryAddrs(ctx context.Context, name string, port int, types []dnsmessage.Type) (insts []Instance, ttl time.Duration, err error) {
+	found := false
+	for _, typ := range types {
+		var m *dnsmessage.Message
+		if m, err = r.query(ctx, name, typ); err != nil {
+			return nil, 0, err
+		}
+		ttl = minTTL(ttl, answerTTL(m))
+
+		if m.RCode == dnsmessage.RCodeNameError {
+			continue
+		}
+		found = true
+
+		insts = appendAddrs(insts, m.Answers, "", port)
+	}
+
+	if !found {
+		return nil, ttl, notFound(name)
+	}
+
+	return insts, ttl, nil
+}
+
+// lookupHosts returns the instances of the addresses of the given types (A or
+// AAAA) the hosts file of r lists host under, with the given port.
+func (r *resolver) lookupHosts(host string, port int, types []dnsmessage.Type) (insts []Instance) {
+	if r.hosts == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(r.hosts)
+	if err != nil {
+		return nil
+	}
+
+	var v4, v6 bool
+	for _, typ := range types {
+		v4 = v4 || typ == dnsmessage.TypeA
+		v6 = v6 || typ == dnsmessage.TypeAAAA
+	}
+	host = strings.TrimSuffix(host, ".")
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(f[0])
+		if ip == nil || (ip.To4() != nil && !v4) || (ip.To4() == nil && !v6) {
+			continue
+		}
+
+		for _, name := range f[1:] {
+			if strings.EqualFold(strings.TrimSuffix(name, "."), host) {
+				insts = append(insts, Instance{
+					IP:   ip,
+					Port: port,
+				})
+
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// lookupSRV returns the instances the SRV records of host denote, along with
+// the TTL of the records. The addresses of the targets are taken from the
+// additional section of the response, or looked up.
+func (r *resolver) lookupSRV(ctx context.Context, host string) (insts []Instance, ttl time.Duration, err error) {
+	for _, name := range r.names(host) {
+		if insts, ttl, err = r.querySRV(ctx, name); conclusive(insts, err) {
+			break
+		}
+	}
+
+	return
+}
+
+// conclusive reports whether the lookup of a name which yielded the given
+// results ends the search; the next name is tried on negative and empty
+// answers.
+func conclusive(insts []Instance, err error) bool {
+	return len(insts) > 0 || (err != nil && !isNXDomain(err))
+}
+
+// querySRV is like lookupSRV, but queries for the fully qualified name only.
+func (r *resolver) querySRV(ctx context.Context, name string) (insts []Instance, ttl time.Duration, err error) {
+	m, err := r.query(ctx, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl = answerTTL(m)
+
+	if m.RCode == dnsmessage.RCodeNameError {
+		return nil, ttl, notFound(name)
+	}
+
+	for _, rr := range m.Answers {
+		srv, ok := rr.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+
+		var (
+			target = srv.Target.String()
+			port   = int(srv.Port)
+			n      = len(insts)
+		)
+		if insts = appendAddrs(insts, m.Additionals, target, port); len(insts) > n {
+			continue
+		}
+
+		var (
+			targets []Instance
+			t       time.Duration
+		)
+		if targets, t, err = r.lookupIP(ctx, target, port); err != nil {
+			return nil, 0, err
+		}
+		ttl = minTTL(ttl, t)
+
+		insts = append(insts, targets...)
+	}
+
+	return insts, ttl, nil
+}
+
+// appendAddrs appends to dst the instances the A and AAAA records of rrs
+// denote, with the given port. Unless name is empty, only the records of name
+// are considered.
+func appendAddrs(dst []Instance, rrs []dnsmessage.Resource, name string, port int) []Instance {
+	for _, rr := range rrs {
+		if name != "" && !strings.EqualFold(rr.Header.Name.String(), name) {
+			continue
+		}
+
+		var ip net.IP
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(append([]byte(nil), body.A[:]...))
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(append([]byte(nil), body.AAAA[:]...))
+		default:
+			continue
+		}
+
+		dst = append(dst, Instance{
+			IP:   ip,
+			Port: port,
+		})
+	}
+
+	return dst
+}
+
+// answerTTL returns the duration for which the answer m carries remains valid;
+// the minimum TTL of its records or, in case it carries none, that of the
+// SOA record of its authority section (as per RFC 2308). It returns zero in
+// case it is unknown.
+func answerTTL(m *dnsmessage.Message) (ttl time.Duration) {
+	for _, rr := range m.Answers {
+		ttl = minTTL(ttl, seconds(rr.Header.TTL))
+	}
+	if len(m.Answers) > 0 {
+		return
+	}
+
+	for _, rr := range m.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			ttl = minTTL(seconds(rr.Header.TTL), seconds(soa.MinTTL))
+		}
+	}
+
+	return
+}
+
+func seconds(ttl uint32) time.Duration {
+	return time.Duration(ttl) * time.Second
+}
+
+// minTTL returns the lesser of the given TTLs, zero denoting an unknown one.
+func minTTL(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+
+	return a
+}
+
+func notFound(host string) error {
+	return &net.DNSError{
+		Err:        "no such host",
+		Name:       host,
+		IsNotFound: true,
+	}
+}
+
+// query queries the name servers of r, in turn, for the records of the given
+// type of name, until one of them answers. Negative answers (NXDOMAIN) are
+// returned as is.
+func (r *resolver) query(ctx context.Context, name string, typ dnsmessage.Type) (*dnsmessage.Message, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	id, q, err := newQuery(name, typ)
+	if err != nil {
+		return nil, &net.DNSError{
+			Err:  err.Error(),
+			Name: name,
+		}
+	}
+
+	var server string
+	for _, server = range r.servers {
+		var m *dnsmessage.Message
+		if m, err = exchange(ctx, "udp", server, id, q); err == nil && m.Truncated {
+			m, err = exchange(ctx, "tcp", server, id, q)
+		}
+
+		switch {
+		case err != nil:
+			continue
+		case m.RCode == dnsmessage.RCodeSuccess, m.RCode == dnsmessage.RCodeNameError:
+			return m, nil
+		default:
+			err = errors.New("server responded with " + m.RCode.String())
+		}
+	}
+
+	return nil, &net.DNSError{
+		Err:         err.Error(),
+		Name:        name,
+		Server:      server,
+		IsTemporary: true,
+	}
+}
+
+// newQuery returns the ID and the packed form of a recursive query for the
+// records of the given type of name.
+func newQuery(name string, typ dnsmessage.Type) (id uint16, q []byte, err error) {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return
+	}
+
+	var rnd [2]byte
+	_, _ = rand.Read(rnd[:])
+	id = binary.BigEndian.Uint16(rnd[:])
+
+	b := dnsmessage.NewBuilder(make([]byte, 2, 512), dnsmessage.Header{
+		ID:               id,
+		RecursionDesired: true,
+	})
+	b.EnableCompression()
+
+	var opt dnsmessage.ResourceHeader
+	if err = opt.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return
+	}
+
+	if err = b.StartQuestions(); err != nil {
+		return
+	}
+	if err = b.Question(dnsmessage.Question{
+		Name:  n,
+		Type:  typ,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return
+	}
+	if err = b.StartAdditionals(); err != nil {
+		return
+	}
+	if err = b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return
+	}
+
+	// the query is prefixed by room for its length, which TCP requires
+	q, err = b.Finish()
+
+	return id, q, err
+}
+
+// exchange sends the query q, the first two bytes of which are reserved for
+// its length, to server over the given network and returns the response.
+func exchange(ctx context.Context, network, server string, id uint16, q []byte) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if network == "tcp" {
+		return exchangeTCP(conn, id, q)
+	}
+
+	if _, err := conn.Write(q[2:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// responses to earlier queries are skipped
+		if m, err := unpack(buf[:n], id); err == nil {
+			return m, nil
+		}
+	}
+}
+
+func exchangeTCP(conn net.Conn, id uint16, q []byte) (*dnsmessage.Message, error) {
+	binary.BigEndian.PutUint16(q, uint16(len(q)-2))
+	if _, err := conn.Write(q); err != nil {
+		return nil, err
+	}
+
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	return unpack(buf, id)
+}
+
+func unpack(b []byte, id uint16) (*dnsmessage.Message, error) {
+	var m dnsmessage.Message
+	if err := m.Unpack(b); err != nil {
+		return nil, err
+	}
+
+	if !m.Response || m.ID != id {
+		return nil, errMismatch
+	}
+
+	return &m, nil
+}
@@ -0,0 +1,365 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// zone maps the names and types a fake name server answers for to the
+// records it answers with.
+type zone map[dnsmessage.Question][]dnsmessage.Resource
+
+func name(s string) dnsmessage.Name {
+	return dnsmessage.MustNewName(s)
+}
+
+func question(n string, typ dnsmessage.Type) dnsmessage.Question {
+	return dnsmessage.Question{Name: name(n), Type: typ, Class: dnsmessage.ClassINET}
+}
+
+func rr(n string, ttl uint32, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name(n), Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	}
+}
+
+// serve starts a fake name server which answers with the records of z, with
+// NXDOMAIN for the names under nx.example. and with an empty answer otherwise.
+// It returns the address of the server.
+func serve(t *testing.T, z zone) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	soa := rr("example.", 300, &dnsmessage.SOAResource{
+		NS:     name("ns.example."),
+		MBox:   name("admin.example."),
+		MinTTL: 20,
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var q dnsmessage.Message
+			if err := q.Unpack(buf[:n]); err != nil {
+				continue
+			}
+
+			m := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: q.ID, Response: true},
+				Questions: q.Questions[:1],
+			}
+			switch qq := q.Questions[0]; {
+			case strings.HasSuffix(qq.Name.String(), "nx.example."):
+				m.RCode = dnsmessage.RCodeNameError
+				m.Authorities = []dnsmessage.Resource{soa}
+			case len(z[qq]) > 0:
+				m.Answers = z[qq]
+				if qq.Type == dnsmessage.TypeSRV {
+					m.Additionals = z[question("additional.", dnsmessage.TypeA)]
+				}
+			default:
+				m.Authorities = []dnsmessage.Resource{soa}
+			}
+
+			if b, err := m.Pack(); err == nil {
+				_, _ = conn.WriteTo(b, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// addrs returns the sorted addresses of insts.
+func addrs(insts []Instance) []string {
+	got := make([]string, 0, len(insts))
+	for _, inst := range insts {
+		got = append(got, (&net.UDPAddr{IP: inst.IP, Port: inst.Port}).String())
+	}
+	sort.Strings(got)
+
+	return got
+}
+
+func TestResolver(t *testing.T) {
+	z := zone{
+		question("a.example.", dnsmessage.TypeA): {
+			rr("a.example.", 60, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}),
+			rr("a.example.", 45, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 2}}),
+		},
+		question("a.example.", dnsmessage.TypeAAAA): {
+			rr("a.example.", 90, &dnsmessage.AAAAResource{AAAA: [16]byte{0xfd, 0xaa, 15: 1}}),
+		},
+		question("v4.example.", dnsmessage.TypeA): {
+			rr("v4.example.", 60, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 3}}),
+		},
+		question("_svc._udp.example.", dnsmessage.TypeSRV): {
+			rr("_svc._udp.example.", 120, &dnsmessage.SRVResource{Target: name("t1.example."), Port: 4000}),
+			rr("_svc._udp.example.", 120, &dnsmessage.SRVResource{Target: name("v4.example."), Port: 5000}),
+		},
+		question("additional.", dnsmessage.TypeA): {
+			rr("t1.example.", 30, &dnsmessage.AResource{A: [4]byte{10, 0, 1, 1}}),
+		},
+	}
+
+	cases := []struct {
+		host     string
+		expected []string
+		ttl      time.Duration
+		notFound bool
+	}{
+		{
+			host:     "a.example",
+			expected: []string{"10.0.0.1:0", "10.0.0.2:0", "[fdaa::1]:0"},
+			ttl:      45 * time.Second,
+		},
+		{
+			// the empty AAAA answer expires along with the SOA record
+			host:     "v4.example",
+			expected: []string{"10.0.0.3:0"},
+			ttl:      20 * time.Second,
+		},
+		{
+			// t1 is found in the additional section; v4 is looked up
+			host:     "_svc._udp.example",
+			expected: []string{"10.0.0.3:5000", "10.0.1.1:4000"},
+			ttl:      20 * time.Second,
+		},
+		{
+			host:     "missing.nx.example",
+			ttl:      20 * time.Second,
+			notFound: true,
+		},
+	}
+
+	r := &resolver{
+		servers: []string{serve(t, z)},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.host, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var (
+				insts []Instance
+				ttl   time.Duration
+				err   error
+			)
+			if strings.HasPrefix(c.host, "_") {
+				insts, ttl, err = r.lookupSRV(ctx, c.host)
+			} else {
+				insts, ttl, err = r.lookupIP(ctx, c.host, 0)
+			}
+
+			switch {
+			case c.notFound && !isNXDomain(err):
+				t.Fatalf("expected NXDOMAIN, got %v", err)
+			case !c.notFound && err != nil:
+				t.Fatal(err)
+			}
+
+			if got := addrs(insts); strings.Join(got, ",") != strings.Join(c.expected, ",") {
+				t.Errorf("expected %v, got %v", c.expected, got)
+			}
+			if ttl != c.ttl {
+				t.Errorf("expected a TTL of %s, got %s", c.ttl, ttl)
+			}
+		})
+	}
+}
+
+func TestResolverFailover(t *testing.T) {
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := dead.LocalAddr().String()
+	_ = dead.Close() // queries to it are refused
+
+	z := zone{
+		question("a.example.", dnsmessage.TypeA): {
+			rr("a.example.", 60, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}),
+		},
+	}
+
+	r := &resolver{
+		servers: []string{addr, serve(t, z)},
+	}
+
+	insts, _, err := r.lookupIP(context.Background(), "a.example", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insts) != 1 {
+		t.Fatalf("expected 1 instance, got %d", len(insts))
+	}
+}
+
+func TestReadResolvConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := "# comment\n" +
+		"nameserver fdaa::3\n" +
+		"nameserver 10.0.0.53\n" +
+		"domain ignored.example\n" +
+		"search svc.example. example\n" +
+		"options timeout:2 ndots:5\n"
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := readResolvConf(path)
+	if got := strings.Join(r.servers, ","); got != "[fdaa::3]:53,10.0.0.53:53" {
+		t.Errorf("unexpected servers: %s", got)
+	}
+	if got := strings.Join(r.search, ","); got != "svc.example.,example." {
+		t.Errorf("unexpected search domains: %s", got)
+	}
+	if r.ndots != 5 {
+		t.Errorf("expected ndots to be 5, got %d", r.ndots)
+	}
+
+	if r = readResolvConf(filepath.Join(t.TempDir(), "missing")); r.ndots != defaultNdots || len(r.servers) != 0 {
+		t.Errorf("unexpected resolver for a missing file: %+v", r)
+	}
+}
+
+func TestResolverSearch(t *testing.T) {
+	z := zone{
+		question("a.example.", dnsmessage.TypeA): {
+			rr("a.example.", 60, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}),
+		},
+		question("b.c.", dnsmessage.TypeA): {
+			rr("b.c.", 60, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 2}}),
+		},
+		question("b.c.example.", dnsmessage.TypeA): {
+			rr("b.c.example.", 60, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 3}}),
+		},
+		question("_svc._udp.example.", dnsmessage.TypeSRV): {
+			rr("_svc._udp.example.", 120, &dnsmessage.SRVResource{Target: name("hosted."), Port: 5000}),
+		},
+	}
+
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hosts, []byte("10.0.9.1 hosted # comment\nfdaa::9 hosted.\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &resolver{
+		servers: []string{serve(t, z)},
+		search:  []string{"nx.example.", "example."},
+		ndots:   1,
+		hosts:   hosts,
+	}
+
+	cases := []struct {
+		host     string
+		expected []string
+	}{
+		// a.nx.example. does not exist, a.example. does
+		{"a", []string{"10.0.0.1:0"}},
+		// tried as is first, since it has ndots dots
+		{"b.c", []string{"10.0.0.2:0"}},
+		// fully qualified names are only tried as is
+		{"a.", nil},
+		{"hosted", []string{"10.0.9.1:0", "[fdaa::9]:0"}},
+		{"_svc._udp", []string{"10.0.9.1:5000", "[fdaa::9]:5000"}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.host, func(t *testing.T) {
+			var (
+				insts []Instance
+				err   error
+			)
+			if strings.HasPrefix(c.host, "_") {
+				insts, _, err = r.lookupSRV(context.Background(), c.host)
+			} else {
+				insts, _, err = r.lookupIP(context.Background(), c.host, 0)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := addrs(insts); strings.Join(got, ",") != strings.Join(c.expected, ",") {
+				t.Errorf("expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestFly(t *testing.T) {
+	z := zone{
+		question("ord.app.internal.", dnsmessage.TypeAAAA): {
+			rr("ord.app.internal.", 5, &dnsmessage.AAAAResource{AAAA: [16]byte{0xfd, 0xaa, 15: 1}}),
+		},
+		question("global.app.internal.", dnsmessage.TypeAAAA): {
+			rr("global.app.internal.", 5, &dnsmessage.AAAAResource{AAAA: [16]byte{0xfd, 0xaa, 15: 1}}),
+			rr("global.app.internal.", 5, &dnsmessage.AAAAResource{AAAA: [16]byte{0xfd, 0xaa, 15: 2}}),
+		},
+		// only AAAA records are looked up
+		question("ord.app.internal.", dnsmessage.TypeA): {
+			rr("ord.app.internal.", 5, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}),
+		},
+	}
+
+	d := &flyDiscoverer{
+		app: "app",
+		r: &resolver{
+			servers: []string{serve(t, z)},
+		},
+	}
+
+	cases := []struct {
+		region   string
+		expected []string
+		ttl      time.Duration
+	}{
+		{"ord", []string{"[fdaa::1]:0"}, 5 * time.Second},
+		{"", []string{"[fdaa::1]:0", "[fdaa::2]:0"}, 5 * time.Second},
+		{"ams", nil, 20 * time.Second},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.region, func(t *testing.T) {
+			insts, ttl, err := d.DiscoverTTL(context.Background(), c.region)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := addrs(insts); strings.Join(got, ",") != strings.Join(c.expected, ",") {
+				t.Errorf("expected %v, got %v", c.expected, got)
+			}
+			if ttl != c.ttl {
+				t.Errorf("expected a TTL of %s, got %s", c.ttl, ttl)
+			}
+			for _, inst := range insts {
+				if inst.Region != c.region {
+					t.Errorf("expected region %q, got %q", c.region, inst.Region)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package discovery
+
+import "context"
+
+// NewStatic returns a Discoverer which discovers the given instances.
+//
+// When asked for the instances of a specific region, the returned Discoverer
+// only reports the instances which were explicitly assigned that region.
+func NewStatic(insts []Instance) Discoverer {
+	return staticDiscoverer(insts)
+}
+
+type staticDiscoverer []Instance
+
+func (sd staticDiscoverer) Discover(_ context.Context, region string) ([]Instance, error) {
+	return filter(sd, region), nil
+}
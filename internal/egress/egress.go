@@ -0,0 +1,110 @@
+// Package egress implements the processing messages undergo before being
+// broadcast to peers.
+package egress
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+
+	"go.uber.org/atomic"
+
+	"github.com/azazeal/flycast/internal/auth"
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/envelope"
+	"github.com/azazeal/flycast/internal/fragment"
+	"github.com/azazeal/flycast/internal/peer"
+	"github.com/azazeal/flycast/internal/reliable"
+	"github.com/azazeal/flycast/internal/seal"
+)
+
+// Pipeline wraps the egress processing.
+type Pipeline struct {
+	env      *envelope.Filter
+	rel      *reliable.Sender
+	auth     *auth.Keyring // nil unless the Pipeline signs what it relays
+	seal     *seal.Sealer  // nil unless relayed packets are encrypted
+	fragSize int
+	nextID   atomic.Uint64
+}
+
+// New returns a Pipeline for the given channel, configured according to the
+// given Context. The Pipelines of raw channels only envelope messages.
+func New(ctx context.Context, ch *config.Channel) *Pipeline {
+	cfg := config.FromContext(ctx)
+
+	p := &Pipeline{
+		env: envelope.FromContext(ctx),
+	}
+	if !ch.Raw {
+		p.rel = reliable.FromContext(ctx)
+		p.seal = seal.FromContext(ctx)
+		p.fragSize = cfg.Fragment.Size
+	}
+	if cfg.Auth.Relay && !ch.Raw {
+		p.auth = auth.FromContext(ctx)
+	}
+
+	if p.rel != nil && p.fragSize > 0 {
+		// fragments are framed by the reliable sender
+		p.fragSize -= reliable.HeaderSize
+	}
+	if p.auth != nil && p.fragSize > 0 {
+		// fragments are signed
+		p.fragSize -= auth.HeaderSize
+	}
+	if p.rel != nil {
+		// the reliable sender signs its frames, along with their header
+		p.auth = nil
+	}
+
+	var seed [8]byte
+	_, _ = rand.Read(seed[:])
+	p.nextID.Store(binary.BigEndian.Uint64(seed[:]))
+
+	return p
+}
+
+// Broadcast processes msgs and sends the results to the peers of pl, via w
+// unless the Pipeline sends reliably.
+//
+// Broadcast returns the number of peers it targeted, the number of those it
+// failed queueing any of the messages for and the number of messages it
+// filtered out as looping or duplicate.
+func (p *Pipeline) Broadcast(pl *peer.List, w peer.Writer, msgs ...[]byte) (peers, failed, filtered int) {
+	pkts := make([]peer.Packet, 0, len(msgs))
+	for _, msg := range msgs {
+		framed, ok := p.env.Process(msg)
+		if !ok {
+			filtered++
+
+			continue
+		}
+		framed = p.seal.Seal(framed)
+
+		// packets are keyed by their payload, regardless of their envelope
+		pkt := peer.Packet{
+			Key: msg,
+		}
+		if _, payload, ok := envelope.Parse(msg); ok {
+			pkt.Key = payload
+		}
+		if p.fragSize > 0 {
+			pkt.Frames = fragment.Split(p.nextID.Inc(), framed, p.fragSize)
+		} else {
+			pkt.Frames = [][]byte{framed}
+		}
+		for i, frame := range pkt.Frames {
+			pkt.Frames[i] = p.auth.Sign(auth.TypeRelay, frame)
+		}
+		pkts = append(pkts, pkt)
+	}
+
+	if p.rel != nil {
+		w = p.rel
+	}
+
+	peers, failed = pl.Send(w, pkts...)
+
+	return
+}
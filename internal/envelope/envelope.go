@@ -0,0 +1,151 @@
+// Package envelope implements the envelope flycast optionally wraps the
+// packets it relays in, in order to detect and drop looping and duplicate
+// packets.
+package envelope
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+
+	"go.uber.org/atomic"
+
+	"github.com/azazeal/flycast/internal/dedup"
+	"github.com/azazeal/flycast/internal/metrics"
+)
+
+// HeaderSize denotes the size of the envelope header.
+const HeaderSize = 20
+
+// magic is the wire prefix of enveloped packets.
+var magic = [...]byte{'f', 'c', 'e', 1}
+
+// Header wraps the properties of the envelope header.
+type Header struct {
+	// Origin identifies the flycast instance which first enveloped the packet.
+	Origin uint64
+
+	// ID identifies the packet amongst the ones of its Origin.
+	ID uint64
+}
+
+// Wrap returns a copy of payload, enveloped with h.
+func Wrap(h Header, payload []byte) []byte {
+	b := make([]byte, HeaderSize+len(payload))
+
+	copy(b, magic[:])
+	binary.BigEndian.PutUint64(b[4:], h.Origin)
+	binary.BigEndian.PutUint64(b[12:], h.ID)
+	copy(b[HeaderSize:], payload)
+
+	return b
+}
+
+// Parse parses the envelope b carries. It reports false in case b carries no
+// envelope.
+func Parse(b []byte) (h Header, payload []byte, ok bool) {
+	if len(b) < HeaderSize || string(b[:len(magic)]) != string(magic[:]) {
+		return
+	}
+
+	h.Origin = binary.BigEndian.Uint64(b[4:])
+	h.ID = binary.BigEndian.Uint64(b[12:])
+
+	return h, b[HeaderSize:], true
+}
+
+// Origin returns the origin identifier of the given instance.
+func Origin(instance string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(instance))
+
+	return h.Sum64()
+}
+
+// The set of exported counters.
+var (
+	wrapped    = metrics.Envelopes.WithLabelValues("wrapped")
+	forwarded  = metrics.Envelopes.WithLabelValues("forwarded")
+	loops      = metrics.Envelopes.WithLabelValues("loop")
+	duplicates = metrics.Envelopes.WithLabelValues("duplicate")
+)
+
+// Filter envelopes packets and drops the ones that loop or that it has
+// already seen.
+type Filter struct {
+	origin uint64
+	nextID atomic.Uint64
+	seen   *dedup.Window[Header]
+}
+
+// NewFilter returns a Filter which envelopes packets on behalf of origin and
+// which remembers the packets it has seen for at least window.
+func NewFilter(origin uint64, window time.Duration) *Filter {
+	f := &Filter{
+		origin: origin,
+		seen:   dedup.New[Header](window),
+	}
+
+	// start from a random ID so that restarts do not reuse recent ones
+	var seed [8]byte
+	_, _ = rand.Read(seed[:])
+	f.nextID.Store(binary.BigEndian.Uint64(seed[:]))
+
+	return f
+}
+
+// Process returns the message which should be relayed in place of msg.
+//
+// Packets which carry no envelope are enveloped on behalf of the Filter's
+// origin, while packets which do are relayed as is. Process reports false for
+// packets which originated from the Filter's origin, and for those it has
+// already seen within its window.
+//
+// Process is safe to call on a nil Filter, in which case msg is returned as is.
+func (f *Filter) Process(msg []byte) ([]byte, bool) {
+	if f == nil {
+		return msg, true
+	}
+
+	h, _, ok := Parse(msg)
+	if !ok {
+		wrapped.Inc()
+
+		return Wrap(Header{
+			Origin: f.origin,
+			ID:     f.nextID.Inc(),
+		}, msg), true
+	}
+
+	switch {
+	case h.Origin == f.origin:
+		loops.Inc()
+
+		return nil, false
+	case !f.seen.Admit(h):
+		duplicates.Inc()
+
+		return nil, false
+	default:
+		forwarded.Inc()
+
+		return msg, true
+	}
+}
+
+type contextKeyType struct{}
+
+// FromContext returns the Filter the given Context carries, or nil in case it
+// carries none.
+func FromContext(ctx context.Context) *Filter {
+	f, _ := ctx.Value(contextKeyType{}).(*Filter)
+
+	return f
+}
+
+// NewContext returns a copy of ctx which carries f.
+func NewContext(ctx context.Context, f *Filter) context.Context {
+	return context.WithValue(ctx, contextKeyType{}, f)
+}
@@ -0,0 +1,279 @@
+// Package fragment implements the fragmentation and reassembly of messages
+// which exceed the path MTU between flycast instances.
+package fragment
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/azazeal/flycast/internal/buffer"
+	"github.com/azazeal/flycast/internal/envelope"
+	"github.com/azazeal/flycast/internal/metrics"
+	"github.com/azazeal/flycast/internal/seal"
+)
+
+// HeaderSize denotes the size of the fragment header.
+const HeaderSize = 16
+
+// MinSize denotes the minimum fragment size.
+const MinSize = 128
+
+// magic is the wire prefix of fragments.
+var magic = [...]byte{'f', 'c', 'f', 1}
+
+// The set of exported counters.
+var (
+	split       = metrics.Fragments.WithLabelValues("split")
+	reassembled = metrics.Fragments.WithLabelValues("reassembled")
+	expired     = metrics.Fragments.WithLabelValues("expired")
+	dropped     = metrics.Fragments.WithLabelValues("dropped")
+)
+
+// Split splits msg into fragments of at most size bytes each, headers
+// included, all of which carry the given message id.
+//
+// Messages which fit in a single fragment are framed all the same, as the
+// only fragment of theirs, so that no message is mistaken for a fragment by
+// the receiving side.
+func Split(id uint64, msg []byte, size int) [][]byte {
+	chunk := size - HeaderSize
+	count := (len(msg) + chunk - 1) / chunk
+	if count == 0 {
+		count = 1 // empty
+	}
+
+	frags := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		part := msg[i*chunk:]
+		if len(part) > chunk {
+			part = part[:chunk]
+		}
+
+		frag := make([]byte, HeaderSize+len(part))
+		copy(frag, magic[:])
+		binary.BigEndian.PutUint64(frag[4:], id)
+		binary.BigEndian.PutUint16(frag[12:], uint16(i))
+		binary.BigEndian.PutUint16(frag[14:], uint16(count))
+		copy(frag[HeaderSize:], part)
+
+		frags = append(frags, frag)
+	}
+	if count > 1 {
+		split.Inc()
+	}
+
+	return frags
+}
+
+type header struct {
+	id    uint64
+	index int
+	count int
+}
+
+func parse(b []byte) (h header, payload []byte, ok bool) {
+	if len(b) < HeaderSize || string(b[:len(magic)]) != string(magic[:]) {
+		return
+	}
+
+	h.id = binary.BigEndian.Uint64(b[4:])
+	h.index = int(binary.BigEndian.Uint16(b[12:]))
+	h.count = int(binary.BigEndian.Uint16(b[14:]))
+
+	return h, b[HeaderSize:], true
+}
+
+// The bounds of the Reassembler.
+const (
+	// timeout denotes the duration after which incomplete messages are
+	// dropped.
+	timeout = 10 * time.Second
+
+	// maxPending denotes the maximum number of incomplete messages.
+	maxPending = 1 << 12
+
+	// maxPendingBytes denotes the maximum number of bytes incomplete messages
+	// may hold, their parts included.
+	maxPendingBytes = 1 << 26
+
+	// maxSize denotes the size of the largest message which is reassembled;
+	// that of the largest datagram, wrapped in an envelope and sealed, plus
+	// some slack for the marker of truncated packets.
+	maxSize = buffer.Size + envelope.HeaderSize + seal.Overhead + 64
+
+	// minChunk denotes a lower bound of the size of fragment payloads; that
+	// of the smallest fragment, less the fragment header and those of
+	// reliable and authenticated frames, rounded down.
+	minChunk = 32
+
+	// maxCount denotes the maximum number of fragments of a message.
+	maxCount = (maxSize + minChunk - 1) / minChunk
+
+	// partCost denotes the number of bytes each part of an incomplete message
+	// costs, in addition to its payload; that of a slice header.
+	partCost = 24
+)
+
+// Reassembler reassembles fragmented messages.
+type Reassembler struct {
+	mu      sync.Mutex
+	swept   time.Time
+	pending map[key]*partial
+	bytes   int // held by pending
+}
+
+type key struct {
+	from string
+	id   uint64
+}
+
+type partial struct {
+	parts   [][]byte
+	have    int
+	size    int
+	chunk   int // the payload size of all but the last fragment
+	expires time.Time
+}
+
+// cost returns the number of bytes p holds.
+func (p *partial) cost() int {
+	return len(p.parts)*partCost + p.size
+}
+
+// NewReassembler returns a new Reassembler.
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		swept:   time.Now(),
+		pending: make(map[key]*partial),
+	}
+}
+
+// Add adds the packet it received from the given source to r.
+//
+// Add returns pkt as is, in case pkt carries no fragment, or the reassembled
+// message in case pkt completes one. Add reports false while the message pkt
+// is a fragment of remains incomplete.
+func (r *Reassembler) Add(from string, pkt []byte) ([]byte, bool) {
+	h, payload, ok := parse(pkt)
+	if !ok {
+		return pkt, true
+	}
+
+	if !plausible(h, len(payload)) {
+		dropped.Inc()
+
+		return nil, false
+	}
+
+	if h.count == 1 {
+		return payload, true // unfragmented
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.sweep(now)
+
+	k := key{from, h.id}
+	p := r.pending[k]
+	switch {
+	case p == nil && (len(r.pending) >= maxPending ||
+		r.bytes+h.count*partCost+len(payload) > maxPendingBytes):
+		dropped.Inc()
+
+		return nil, false
+	case p == nil:
+		p = &partial{
+			parts:   make([][]byte, h.count),
+			expires: now.Add(timeout),
+		}
+		r.pending[k] = p
+		r.bytes += p.cost()
+	case len(p.parts) != h.count:
+		return nil, false // inconsistent fragment
+	case p.parts[h.index] != nil:
+		return nil, false // duplicate fragment
+	case !p.fits(h.index, len(payload)) || r.bytes+len(payload) > maxPendingBytes:
+		r.drop(k, p)
+		dropped.Inc()
+
+		return nil, false
+	}
+
+	p.parts[h.index] = append([]byte(nil), payload...)
+	p.have++
+	p.size += len(payload)
+	r.bytes += len(payload)
+	if h.index < len(p.parts)-1 {
+		p.chunk = len(payload)
+	}
+
+	if p.have < len(p.parts) {
+		return nil, false
+	}
+	r.drop(k, p)
+
+	msg := make([]byte, 0, p.size)
+	for _, part := range p.parts {
+		msg = append(msg, part...)
+	}
+	reassembled.Inc()
+
+	return msg, true
+}
+
+// plausible reports whether a fragment of the given header and payload size
+// may belong to a message of at most maxSize bytes. All fragments but the last
+// carry payloads of the same size, which determines the size of the message.
+func plausible(h header, size int) bool {
+	switch {
+	case h.index >= h.count, h.count > maxCount:
+		return false
+	case size == 0:
+		return h.count == 1 // an empty message
+	case h.index < h.count-1:
+		return (h.count-1)*size < maxSize
+	default:
+		return size <= maxSize
+	}
+}
+
+// fits reports whether a fragment of p of the given index and payload size is
+// consistent with those p holds, and keeps p within maxSize bytes.
+func (p *partial) fits(index, size int) bool {
+	last := index == len(p.parts)-1
+
+	switch {
+	case p.size+size > maxSize:
+		return false
+	case p.chunk == 0:
+		return true
+	case last:
+		return size <= p.chunk
+	default:
+		return size == p.chunk
+	}
+}
+
+// drop forgets the incomplete message p under k.
+func (r *Reassembler) drop(k key, p *partial) {
+	delete(r.pending, k)
+	r.bytes -= p.cost()
+}
+
+func (r *Reassembler) sweep(now time.Time) {
+	if now.Sub(r.swept) < timeout {
+		return
+	}
+	r.swept = now
+
+	for k, p := range r.pending {
+		if now.After(p.expires) {
+			r.drop(k, p)
+
+			expired.Inc()
+		}
+	}
+}
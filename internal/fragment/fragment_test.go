@@ -0,0 +1,169 @@
+package fragment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		size int // of the message
+		frag int // fragment size
+	}{
+		{"unfragmented", 100, MinSize},
+		{"single", MinSize - HeaderSize, MinSize},
+		{"empty", 0, MinSize},
+		{"exact", 2 * (MinSize - HeaderSize), MinSize},
+		{"uneven", 1000, MinSize},
+		{"largest", maxSize, 1200},
+		{"smallest chunks", maxSize, HeaderSize + minChunk},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			msg := make([]byte, c.size)
+			_, _ = rand.Read(msg)
+
+			frags := Split(1, msg, c.frag)
+			rand.Shuffle(len(frags), func(i, j int) {
+				frags[i], frags[j] = frags[j], frags[i]
+			})
+
+			var (
+				r   = NewReassembler()
+				got []byte
+			)
+			for i, frag := range frags {
+				if len(frag) > c.frag {
+					t.Fatalf("fragment %d is %d bytes long", i, len(frag))
+				}
+
+				var ok bool
+				if got, ok = r.Add("src", frag); ok != (i == len(frags)-1) {
+					t.Fatalf("fragment %d of %d completed: %v", i, len(frags), ok)
+				}
+			}
+
+			if !bytes.Equal(got, msg) {
+				t.Fatal("reassembled message differs")
+			}
+			if len(r.pending) != 0 || r.bytes != 0 {
+				t.Fatalf("%d messages of %d bytes remain pending", len(r.pending), r.bytes)
+			}
+		})
+	}
+}
+
+func TestLookalike(t *testing.T) {
+	// messages which fit in a fragment, but look like fragments themselves
+	cases := []struct {
+		name string
+		msg  []byte
+	}{
+		{"first of two", frag(7, 0, 2, 10)},
+		{"last of two", frag(7, 1, 2, 10)},
+		{"only", frag(7, 0, 1, 10)},
+		{"header only", frag(7, 0, 2, 0)},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			frags := Split(1, c.msg, MinSize)
+			if len(frags) != 1 {
+				t.Fatalf("split into %d fragments", len(frags))
+			}
+
+			r := NewReassembler()
+
+			got, ok := r.Add("src", frags[0])
+			switch {
+			case !ok:
+				t.Fatal("the message is incomplete")
+			case !bytes.Equal(got, c.msg):
+				t.Fatalf("expected %x, got %x", c.msg, got)
+			case len(r.pending) != 0:
+				t.Fatalf("%d messages remain pending", len(r.pending))
+			}
+		})
+	}
+}
+
+func frag(id uint64, index, count, size int) []byte {
+	b := make([]byte, HeaderSize+size)
+	copy(b, magic[:])
+	binary.BigEndian.PutUint64(b[4:], id)
+	binary.BigEndian.PutUint16(b[12:], uint16(index))
+	binary.BigEndian.PutUint16(b[14:], uint16(count))
+
+	return b
+}
+
+func TestBounds(t *testing.T) {
+	cases := []struct {
+		name  string
+		frags [][]byte
+	}{
+		{"too many fragments", [][]byte{
+			frag(1, 0, maxCount+1, 1),
+		}},
+		{"too many fragments of the last", [][]byte{
+			frag(1, 0xfffe, 0xffff, 1),
+		}},
+		{"oversized message", [][]byte{
+			frag(1, 0, 2, maxSize),
+		}},
+		{"empty payload", [][]byte{
+			frag(1, 0, 2, 0),
+		}},
+		{"index out of range", [][]byte{
+			frag(1, 2, 2, 100),
+		}},
+		{"inconsistent chunks", [][]byte{
+			frag(1, 0, 3, 100),
+			frag(1, 1, 3, 200),
+			frag(1, 2, 3, 10),
+		}},
+		{"oversized last fragment", [][]byte{
+			frag(1, 0, 2, 100),
+			frag(1, 1, 2, 101),
+		}},
+		{"inconsistent count", [][]byte{
+			frag(1, 0, 2, 100),
+			frag(1, 1, 3, 100),
+		}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			r := NewReassembler()
+			for i, f := range c.frags {
+				if _, ok := r.Add("src", f); ok {
+					t.Fatalf("fragment %d completed a message", i)
+				}
+			}
+		})
+	}
+}
+
+func TestPendingBytes(t *testing.T) {
+	r := NewReassembler()
+
+	// fragments which claim the most parts, each of which costs partCost
+	for id := uint64(0); id < maxPending; id++ {
+		_, _ = r.Add("src", frag(id, maxCount-1, maxCount, 1))
+
+		if r.bytes > maxPendingBytes {
+			t.Fatalf("%d pending messages hold %d bytes", len(r.pending), r.bytes)
+		}
+	}
+
+	if len(r.pending) == maxPending {
+		t.Fatal("the pending bytes were not capped")
+	}
+}
@@ -0,0 +1,117 @@
+// Package latency implements the per-region latency estimates flycast ranks
+// regions by, along with the probes which refine them.
+package latency
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/azazeal/flycast/internal/metrics"
+)
+
+// weight denotes the weight of each observation in the moving average of the
+// estimates.
+const weight = 0.25
+
+// Table holds the round-trip time estimates from the local region to others.
+//
+// Table is safe for concurrent use.
+type Table struct {
+	mu  sync.Mutex
+	est map[string]time.Duration
+}
+
+// NewTable returns a Table seeded with the given static estimates.
+func NewTable(static map[string]time.Duration) *Table {
+	t := &Table{
+		est: make(map[string]time.Duration, len(static)),
+	}
+
+	for region, rtt := range static {
+		t.set(region, rtt)
+	}
+
+	return t
+}
+
+// Observe folds the given round-trip time to region into its estimate.
+func (t *Table) Observe(region string, rtt time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if est, ok := t.est[region]; ok {
+		rtt = est + time.Duration(weight*float64(rtt-est))
+	}
+	t.set(region, rtt)
+}
+
+func (t *Table) set(region string, rtt time.Duration) {
+	t.est[region] = rtt
+
+	metrics.RegionLatency.WithLabelValues(region).Set(rtt.Seconds())
+}
+
+// Estimate returns the round-trip time estimate of the given region and
+// reports whether there is one.
+func (t *Table) Estimate(region string) (rtt time.Duration, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rtt, ok = t.est[region]
+
+	return
+}
+
+// Nearest returns the local region along with the n of the given regions
+// which are nearest to it. Regions with estimates rank ahead of those without;
+// ties are broken by name.
+func (t *Table) Nearest(local string, regions []string, n int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	candidates := make([]string, 0, len(regions))
+	seen := map[string]struct{}{local: {}}
+	for _, r := range regions {
+		if _, dup := seen[r]; !dup {
+			seen[r] = struct{}{}
+			candidates = append(candidates, r)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		ei, iok := t.est[candidates[i]]
+		ej, jok := t.est[candidates[j]]
+
+		switch {
+		case iok != jok:
+			return iok
+		case ei != ej:
+			return ei < ej
+		default:
+			return candidates[i] < candidates[j]
+		}
+	})
+
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+
+	return append(candidates, local)
+}
+
+type contextKeyType struct{}
+
+// FromContext returns the Table the given Context carries, or nil in case it
+// carries none.
+func FromContext(ctx context.Context) *Table {
+	t, _ := ctx.Value(contextKeyType{}).(*Table)
+
+	return t
+}
+
+// NewContext returns a copy of ctx which carries t.
+func NewContext(ctx context.Context, t *Table) context.Context {
+	return context.WithValue(ctx, contextKeyType{}, t)
+}
@@ -0,0 +1,342 @@
+package latency
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/azazeal/health"
+	"go.uber.org/zap"
+
+	"github.com/azazeal/flycast/internal/auth"
+	"github.com/azazeal/flycast/internal/buffer"
+	"github.com/azazeal/flycast/internal/common"
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/log"
+	"github.com/azazeal/flycast/internal/loop"
+)
+
+// probeHeaderSize denotes the size of the probe header.
+const probeHeaderSize = 13
+
+// maxRTT denotes the round-trip time beyond which pongs are ignored.
+const maxRTT = 10 * time.Second
+
+// maxPending denotes the maximum number of pings awaiting their pongs.
+const maxPending = 1 << 12
+
+// magic is the wire prefix of probes.
+var magic = [...]byte{'f', 'c', 'p', 1}
+
+// The set of probe types.
+const (
+	typePing byte = iota + 1
+	typePong
+)
+
+// encode returns a probe of the given type, which carries the time it was
+// sent at along with the region it was sent to.
+func encode(typ byte, at time.Time, region string) []byte {
+	b := make([]byte, probeHeaderSize+len(region))
+
+	copy(b, magic[:])
+	b[4] = typ
+	binary.BigEndian.PutUint64(b[5:], uint64(at.UnixNano()))
+	copy(b[probeHeaderSize:], region)
+
+	return b
+}
+
+func parse(b []byte) (typ byte, at time.Time, region string, ok bool) {
+	if len(b) < probeHeaderSize || string(b[:len(magic)]) != string(magic[:]) {
+		return
+	}
+
+	typ = b[4]
+	at = time.Unix(0, int64(binary.BigEndian.Uint64(b[5:])))
+
+	return typ, at, string(b[probeHeaderSize:]), true
+}
+
+// Pong returns the response to the ping b carries. It reports false in case b
+// carries no ping.
+func Pong(b []byte) ([]byte, bool) {
+	if typ, _, _, ok := parse(b); !ok || typ != typePing {
+		return nil, false
+	}
+
+	pong := append([]byte(nil), b...)
+	pong[4] = typePong
+
+	return pong, true
+}
+
+// Probe returns a Prober which, for as long as ctx is not done, folds the
+// round-trip times of the probes it sends into t.
+//
+// Pings are sent to the probe port of the flycast instances, which is assumed
+// to be the same as the local one. When relayed packets are authenticated, so
+// are probes: pings are signed as relayed packets and pongs are verified as
+// replies.
+//
+// When ctx is done and the Prober has stopped, Done will be called on wg.
+func Probe(ctx context.Context, wg *sync.WaitGroup, t *Table) *Prober {
+	var (
+		cfg = config.FromContext(ctx)
+		hc  = health.FromContext(ctx)
+
+		p = &Prober{
+			logger: log.FromContext(ctx).Named("probe"),
+			t:      t,
+			port:   cfg.Ports.Probe,
+		}
+	)
+	if cfg.Auth.Relay {
+		p.auth = auth.FromContext(ctx)
+	}
+
+	go func() {
+		defer wg.Done()
+
+		loop.Func(ctx, time.Second, func(ctx context.Context) {
+			defer hc.Fail(common.HCProbe)
+
+			conn := bind(p.logger)
+			if conn == nil {
+				return
+			}
+			hc.Pass(common.HCProbe)
+
+			p.setConn(conn)
+			defer p.setConn(nil)
+
+			p.run(ctx, conn)
+		})
+	}()
+
+	return p
+}
+
+// Prober implements latency probing.
+type Prober struct {
+	logger *zap.Logger
+	t      *Table
+	port   int           // the probe port
+	auth   *auth.Keyring // nil unless probes are authenticated
+
+	mu      sync.Mutex
+	conn    net.PacketConn
+	pending map[ping]string // regions, by the pings awaiting pongs
+}
+
+// ping identifies a ping by the address it was sent to and the time it was
+// sent at.
+type ping struct {
+	addr netip.AddrPort
+	at   int64
+}
+
+func newPing(addr net.Addr, at time.Time) (ping, bool) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return ping{}, false
+	}
+	ap := ua.AddrPort()
+
+	return ping{
+		addr: netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()),
+		at:   at.UnixNano(),
+	}, true
+}
+
+// Ping sends a ping to the probe port of the flycast instance at addr, which
+// runs in the given region. Ping is safe to call on a nil Prober.
+func (p *Prober) Ping(addr net.Addr, region string) {
+	if p == nil {
+		return
+	}
+
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	addr = &net.UDPAddr{IP: ua.IP, Port: p.port, Zone: ua.Zone}
+
+	now := time.Now()
+	key, ok := newPing(addr, now)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	conn := p.conn
+	if conn != nil {
+		p.track(key, region, now)
+	}
+	p.mu.Unlock()
+
+	if conn == nil {
+		return // not bound
+	}
+
+	if _, err := conn.WriteTo(p.auth.Sign(auth.TypeRelay, encode(typePing, now, region)), addr); err != nil {
+		p.logger.Debug("failed pinging.",
+			log.Addr(addr),
+			zap.Error(err))
+	}
+}
+
+// track records the ping of the given key, which is sent to the given region.
+// Pings which have gone unanswered for longer than maxRTT are forgotten.
+func (p *Prober) track(key ping, region string, now time.Time) {
+	if p.pending == nil {
+		p.pending = make(map[ping]string)
+	}
+
+	if len(p.pending) >= maxPending {
+		for k := range p.pending {
+			if now.Sub(time.Unix(0, k.at)) > maxRTT {
+				delete(p.pending, k)
+			}
+		}
+
+		if len(p.pending) >= maxPending {
+			return // the pong will be ignored
+		}
+	}
+
+	p.pending[key] = region
+}
+
+// answered returns the region of the ping the pong of the given key answers,
+// and reports false in case there is no such ping.
+func (p *Prober) answered(key ping) (region string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if region, ok = p.pending[key]; ok {
+		delete(p.pending, key)
+	}
+
+	return
+}
+
+func (p *Prober) setConn(conn net.PacketConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.conn = conn
+	p.pending = nil
+}
+
+func (p *Prober) run(ctx context.Context, conn net.PacketConn) {
+	exited := make(chan struct{})
+	defer close(exited)
+
+	closer := common.CloseOnce(conn)
+	defer closer.Close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		select {
+		case <-ctx.Done():
+			_ = closer.Close()
+		case <-exited:
+			break
+		}
+	}()
+
+	buf := buffer.Get()
+	defer buffer.Put(buf)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf[:])
+		if err != nil {
+			if ctx.Err() == nil {
+				p.logger.Warn("failed reading.",
+					zap.Error(err))
+			}
+
+			return
+		}
+
+		pkt, ok := p.auth.Verify(auth.TypeReply, buf[:n])
+		if !ok {
+			p.logger.Debug("dropped unauthenticated pong.",
+				log.Addr(addr))
+
+			continue
+		}
+
+		typ, at, _, ok := parse(pkt)
+		if !ok || typ != typePong {
+			continue
+		}
+
+		// only the pongs of the pings sent are accepted, and they are
+		// attributed to the region the pings were sent to
+		key, ok := newPing(addr, at)
+		if !ok {
+			continue
+		}
+
+		region, ok := p.answered(key)
+		if !ok {
+			p.logger.Debug("dropped unsolicited pong.",
+				log.Addr(addr))
+
+			continue
+		}
+
+		rtt := time.Since(at)
+		if rtt < 0 || rtt > maxRTT {
+			continue // stale
+		}
+
+		p.logger.Debug("received pong.",
+			log.Addr(addr),
+			zap.String("region", region),
+			zap.Duration("rtt", rtt))
+
+		p.t.Observe(region, rtt)
+	}
+}
+
+func bind(logger *zap.Logger) net.PacketConn {
+	logger.Info("binding ...")
+
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		logger.Warn("failed binding.",
+			zap.Error(err))
+
+		return nil
+	}
+	logger.Debug("bound.",
+		log.Addr(conn.LocalAddr()))
+
+	return conn
+}
+
+type proberKeyType struct{}
+
+// ProberFromContext returns the Prober the given Context carries, or nil in
+// case it carries none.
+func ProberFromContext(ctx context.Context) *Prober {
+	p, _ := ctx.Value(proberKeyType{}).(*Prober)
+
+	return p
+}
+
+// NewProberContext returns a copy of ctx which carries p.
+func NewProberContext(ctx context.Context, p *Prober) context.Context {
+	return context.WithValue(ctx, proberKeyType{}, p)
+}
@@ -0,0 +1,266 @@
+// Package metrics implements the Prometheus metrics the application exports.
+package metrics
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "flycast"
+
+// The set of metrics the wire subsystem exports.
+var (
+	// PacketsReceived counts the packets read, per listening port.
+	PacketsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "wire",
+		Name:      "packets_received_total",
+		Help:      "The number of packets read, per listening port.",
+	}, []string{"port"})
+
+	// BytesReceived counts the bytes read, per listening port.
+	BytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "wire",
+		Name:      "bytes_received_total",
+		Help:      "The number of bytes read, per listening port.",
+	}, []string{"port"})
+
+	// BindRetries counts the failed attempts to bind a listening port.
+	BindRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "wire",
+		Name:      "bind_retries_total",
+		Help:      "The number of failed attempts to bind, per listening port.",
+	}, []string{"port"})
+
+	// Truncated counts the truncated packets read, per listening port and
+	// policy (drop or mark).
+	Truncated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "wire",
+		Name:      "truncated_packets_total",
+		Help:      "The number of truncated packets read, per listening port and policy.",
+	}, []string{"port", "policy"})
+
+	// Rejected counts the packets dropped due to their source, per listening
+	// port and rule (deny or allow).
+	Rejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "wire",
+		Name:      "rejected_packets_total",
+		Help:      "The number of packets dropped due to their source, per listening port and rule.",
+	}, []string{"port", "rule"})
+
+	// Throttled counts the packets dropped due to rate limits, per listening
+	// port and limit (source_packets, source_bytes, port_packets or
+	// port_bytes).
+	Throttled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "wire",
+		Name:      "throttled_packets_total",
+		Help:      "The number of packets dropped due to rate limits, per listening port and limit.",
+	}, []string{"port", "limit"})
+
+	// RateLimitedSources reports the number of sources rate limits are tracked
+	// for, per listening port.
+	RateLimitedSources = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "wire",
+		Name:      "rate_limited_sources",
+		Help:      "The number of sources rate limits are tracked for, per listening port.",
+	}, []string{"port"})
+
+	// Envelopes counts the packets processed in envelope mode, per result
+	// (wrapped, forwarded, loop or duplicate).
+	Envelopes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "wire",
+		Name:      "envelope_packets_total",
+		Help:      "The number of packets processed in envelope mode, per result.",
+	}, []string{"result"})
+)
+
+// The set of metrics the peer subsystem exports.
+var (
+	// PacketsSent counts the packets sent, per peer.
+	PacketsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "packets_sent_total",
+		Help:      "The number of packets sent, per peer.",
+	}, []string{"scope", "peer", "region"})
+
+	// SendErrors counts the packets which failed to be sent, per peer.
+	SendErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "send_errors_total",
+		Help:      "The number of packets which failed to be sent, per peer.",
+	}, []string{"scope", "peer", "region"})
+
+	// QueueDrops counts the packets which were dropped since the send queue
+	// of their peer was full, per peer.
+	QueueDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "queue_drops_total",
+		Help:      "The number of packets dropped due to a full send queue, per peer.",
+	}, []string{"scope", "peer", "region"})
+
+	// Peers reports the current number of peers, per peer list.
+	Peers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "peers",
+		Help:      "The current number of peers, per peer list.",
+	}, []string{"scope"})
+
+	// PeerEvents counts the changes in the membership of peer lists, per peer
+	// list and event (joined or left).
+	PeerEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "events_total",
+		Help:      "The number of peer list membership changes, per peer list and event.",
+	}, []string{"scope", "event"})
+
+	// RefreshInterval reports the current interval between peer resolutions,
+	// per peer list.
+	RefreshInterval = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "refresh_interval_seconds",
+		Help:      "The current interval between peer resolutions, per peer list.",
+	}, []string{"scope"})
+
+	// Staleness reports the duration since the last successful peer
+	// resolution, per peer list, or zero while the last one succeeded.
+	Staleness = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "staleness_seconds",
+		Help:      "The duration since the last successful peer resolution, per peer list.",
+	}, []string{"scope"})
+
+	// ResolveDuration observes the duration of peer resolutions, per peer
+	// list.
+	ResolveDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "resolve_duration_seconds",
+		Help:      "The duration of peer resolutions, per peer list.",
+		Buckets:   prometheus.ExponentialBuckets(.001, 2, 12),
+	}, []string{"scope"})
+
+	// ResolveFailures counts the failed peer resolutions, per peer list.
+	ResolveFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "resolve_failures_total",
+		Help:      "The number of failed peer resolutions, per peer list.",
+	}, []string{"scope"})
+)
+
+// The set of metrics the reliable delivery subsystem exports.
+var (
+	// ReliableFrames counts the reliable data frames, per result (sent,
+	// retransmitted, acknowledged or lost).
+	ReliableFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "reliable",
+		Name:      "frames_total",
+		Help:      "The number of reliable data frames, per result.",
+	}, []string{"result"})
+)
+
+// The set of metrics the fragmentation subsystem exports.
+var (
+	// Fragments counts the fragmented messages, per result (split,
+	// reassembled, expired or dropped).
+	Fragments = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "fragment",
+		Name:      "messages_total",
+		Help:      "The number of fragmented messages, per result.",
+	}, []string{"result"})
+)
+
+// The set of metrics the relay subsystem exports.
+var (
+	// RelayPackets counts the packets received on the relay port, per result
+	// (accepted or duplicate).
+	RelayPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "relay",
+		Name:      "packets_total",
+		Help:      "The number of packets received on the relay port, per result.",
+	}, []string{"result"})
+
+	// Deliveries counts the deliveries to local destinations, per destination
+	// and result (delivered, failed, or dropped due to a full destination).
+	Deliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "relay",
+		Name:      "deliveries_total",
+		Help:      "The number of deliveries to local destinations, per destination and result.",
+	}, []string{"destination", "result"})
+)
+
+// The set of metrics the auth subsystem exports.
+var (
+	// AuthPackets counts the packets verified, per kind (ingress, relay or ack)
+	// and result (accepted, unauthenticated, invalid, expired or replayed).
+	AuthPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "packets_total",
+		Help:      "The number of packets verified, per kind and result.",
+	}, []string{"kind", "result"})
+)
+
+// The set of metrics the encrypt subsystem exports.
+var (
+	// Sealed counts the payloads sealed and opened, per result (sealed,
+	// opened, unsealed, unknown_key or failed).
+	Sealed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "encrypt",
+		Name:      "payloads_total",
+		Help:      "The number of payloads sealed and opened, per result.",
+	}, []string{"result"})
+)
+
+// The set of metrics the latency subsystem exports.
+var (
+	// RegionLatency reports the round-trip time estimates from the local
+	// region, per region.
+	RegionLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "latency",
+		Name:      "rtt_seconds",
+		Help:      "The estimated round-trip time from the local region, per region.",
+	}, []string{"region"})
+
+	// ProbesAnswered counts the probes answered on the probe port.
+	ProbesAnswered = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "latency",
+		Name:      "probes_answered_total",
+		Help:      "The number of probes answered on the probe port.",
+	})
+)
+
+// Port is shorthand for strconv.Itoa(port).
+func Port(port int) string {
+	return strconv.Itoa(port)
+}
+
+// ForgetPeer deletes the series of the given peer.
+func ForgetPeer(scope, peer, region string) {
+	PacketsSent.DeleteLabelValues(scope, peer, region)
+	SendErrors.DeleteLabelValues(scope, peer, region)
+	QueueDrops.DeleteLabelValues(scope, peer, region)
+}
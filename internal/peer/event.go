@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/azazeal/flycast/internal/metrics"
+)
+
+// EventType denotes the type of an Event.
+type EventType int
+
+// The set of event types.
+const (
+	// Joined denotes a peer being added to a List.
+	Joined EventType = iota + 1
+
+	// Left denotes a peer being removed from a List.
+	Left
+)
+
+// String implements fmt.Stringer for EventType.
+func (typ EventType) String() string {
+	switch typ {
+	case Joined:
+		return "joined"
+	case Left:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// Event denotes a change in the membership of a List.
+type Event struct {
+	Type    EventType
+	Channel string // the name of the channel of the List
+	Peer    string // the address of the peer
+	Region  string // the region of the peer
+}
+
+// eventBuffer denotes the capacity of the channels Subscribe returns.
+const eventBuffer = 1 << 6
+
+// Subscribe returns a channel on which the membership changes of l will be
+// delivered until either ctx is done or l stops being refreshed, at which
+// point the channel is closed.
+//
+// Events are dropped for subscribers which fall behind.
+func (l *List) Subscribe(ctx context.Context) <-chan Event {
+	ch := make(chan Event, eventBuffer)
+
+	l.subs.mu.Lock()
+	defer l.subs.mu.Unlock()
+
+	if l.subs.closed {
+		close(ch)
+
+		return ch
+	}
+
+	if l.subs.chans == nil {
+		l.subs.chans = make(map[chan Event]struct{})
+		l.subs.done = make(chan struct{})
+	}
+	l.subs.chans[ch] = struct{}{}
+
+	done := l.subs.done
+	go func() {
+		select {
+		case <-ctx.Done():
+			break
+		case <-done:
+			return // closed by unsubscribeAll
+		}
+
+		l.subs.mu.Lock()
+		defer l.subs.mu.Unlock()
+
+		if _, ok := l.subs.chans[ch]; ok {
+			delete(l.subs.chans, ch)
+			close(ch)
+		}
+	}()
+
+	return ch
+}
+
+// subscribers wraps the subscriptions to the events of a List.
+type subscribers struct {
+	mu     sync.Mutex
+	chans  map[chan Event]struct{}
+	done   chan struct{} // closed along with chans, once l stops
+	closed bool
+}
+
+// publish logs, counts and delivers the given events to the subscribers of l.
+func (l *List) publish(events []Event) {
+	for _, e := range events {
+		l.logger.Info("instance "+e.Type.String()+".",
+			zap.String("instance", e.Peer),
+			zap.String("region", e.Region))
+
+		metrics.PeerEvents.WithLabelValues(l.scope, e.Type.String()).Inc()
+	}
+
+	l.subs.mu.Lock()
+	defer l.subs.mu.Unlock()
+
+	for ch := range l.subs.chans {
+		for _, e := range events {
+			select {
+			case ch <- e:
+			default:
+				// subscriber fell behind
+			}
+		}
+	}
+}
+
+// unsubscribeAll closes the channels of all the subscribers of l.
+func (l *List) unsubscribeAll() {
+	l.subs.mu.Lock()
+	defer l.subs.mu.Unlock()
+
+	if l.subs.closed {
+		return
+	}
+
+	for ch := range l.subs.chans {
+		delete(l.subs.chans, ch)
+		close(ch)
+	}
+	if l.subs.done != nil {
+		close(l.subs.done)
+	}
+	l.subs.closed = true
+}
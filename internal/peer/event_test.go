@@ -0,0 +1,126 @@
+package peer
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+// received returns the events ch holds, sorted, without blocking. It reports
+// false in case ch has been closed.
+func received(ch <-chan Event) (events []Event, open bool) {
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return events, false
+			}
+			events = append(events, e)
+		default:
+			sort.Slice(events, func(i, j int) bool {
+				return events[i].Peer < events[j].Peer
+			})
+
+			return events, true
+		}
+	}
+}
+
+// closed waits for ch to be closed, discarding what it holds, and reports
+// false in case it is not closed within a second.
+func closed(ch <-chan Event) bool {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return true
+			}
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	var (
+		l = newTestList(t, "events")
+
+		a = "127.0.0.1:10000"
+		b = "127.0.0.1:10001"
+
+		joined = func(peer string) Event { return Event{Joined, "events", peer, "ord"} }
+		left   = func(peer string) Event { return Event{Left, "events", peer, "ord"} }
+	)
+	defer l.stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub := l.Subscribe(ctx)
+
+	steps := []struct {
+		name     string
+		peers    int
+		expected []Event
+	}{
+		{"join", 2, []Event{joined(a), joined(b)}},
+		{"leave", 1, []Event{left(b)}},
+		{"unchanged", 1, nil},
+		{"re-join", 2, []Event{joined(b)}},
+		{"leave all", 0, []Event{left(a), left(b)}},
+		{"join again", 1, []Event{joined(a)}},
+	}
+
+	for _, s := range steps {
+		if events := l.update(instances(10000, s.peers)); len(events) != len(s.expected) {
+			t.Fatalf("%s: expected %d events, got %v", s.name, len(s.expected), events)
+		}
+
+		got, open := received(sub)
+		if !open {
+			t.Fatalf("%s: the subscription was closed", s.name)
+		}
+		if len(got) != len(s.expected) {
+			t.Fatalf("%s: expected %v, got %v", s.name, s.expected, got)
+		}
+		for i, e := range s.expected {
+			if got[i] != e {
+				t.Errorf("%s: expected %v, got %v", s.name, e, got[i])
+			}
+		}
+	}
+
+	// canceling the context of a subscription closes it, and it alone
+	other := l.Subscribe(context.Background())
+	cancel()
+	if !closed(sub) {
+		t.Fatal("the subscription outlived its context")
+	}
+
+	l.update(nil)
+	if got, open := received(other); !open || len(got) != 1 || got[0] != left(a) {
+		t.Fatalf("expected the other subscription to receive %v, got %v", left(a), got)
+	}
+
+	// unsubscribing closes the rest, and stops waiting on their contexts
+	l.stop()
+	before := runtime.NumGoroutine()
+
+	l.unsubscribeAll()
+	if !closed(other) {
+		t.Fatal("the subscription outlived the list")
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() >= before; {
+		if time.Now().After(deadline) {
+			t.Fatal("the goroutine of the subscription leaked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if !closed(l.Subscribe(context.Background())) {
+		t.Error("subscribed to a list which has stopped")
+	}
+}
@@ -0,0 +1,209 @@
+package peer
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/latency"
+)
+
+// replicas denotes the number of points each peer occupies on the hash ring.
+const replicas = 64
+
+// snapshot is an immutable view of the peer set, indexed for the delivery
+// modes.
+type snapshot struct {
+	set     peerSet
+	targets []*target            // sorted by address
+	regions map[string][]*target // keyed by region
+	ring    []point              // sorted by hash; nil unless hashing
+}
+
+// point is a point of the hash ring.
+type point struct {
+	hash uint64
+	t    *target
+}
+
+// newSnapshot returns the snapshot of the given set, indexed for the given
+// delivery mode.
+func newSnapshot(set peerSet, mode string) *snapshot {
+	s := &snapshot{
+		set:     set,
+		targets: make([]*target, 0, len(set)),
+		regions: make(map[string][]*target),
+	}
+
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		t := set[key]
+
+		s.targets = append(s.targets, t)
+		s.regions[t.region] = append(s.regions[t.region], t)
+	}
+
+	if mode == config.ModeHash {
+		s.ring = make([]point, 0, replicas*len(keys))
+		for _, key := range keys {
+			for i := 0; i < replicas; i++ {
+				s.ring = append(s.ring, point{
+					hash: hash([]byte(key + "#" + strconv.Itoa(i))),
+					t:    set[key],
+				})
+			}
+		}
+		sort.Slice(s.ring, func(i, j int) bool {
+			return s.ring[i].hash < s.ring[j].hash
+		})
+	}
+
+	return s
+}
+
+// lookup returns the peer which owns the given hash.
+func (s *snapshot) lookup(h uint64) *target {
+	i := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= h
+	})
+	if i == len(s.ring) {
+		i = 0 // wrap around
+	}
+
+	return s.ring[i].t
+}
+
+func hash(b []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+
+	return h.Sum64()
+}
+
+// Packet is a packet along with the frames it is sent as.
+type Packet struct {
+	// Key holds the contents the peers of the packet are selected by.
+	Key []byte
+
+	// Frames holds the messages the packet is sent as.
+	Frames [][]byte
+}
+
+// selector selects the peers of packets according to the delivery mode of a
+// channel.
+type selector struct {
+	mode   string
+	fanout int
+	prefix int
+	local  string
+	table  *latency.Table
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// newSelector returns the selector of the given channel, which must not
+// broadcast. newSelector panics in case the mode of ch is unknown, or its
+// fanout is not positive, since config validates both.
+func newSelector(ch *config.Channel, local string, table *latency.Table) *selector {
+	switch {
+	case ch.Mode == config.ModeRandom && ch.Fanout > 0,
+		ch.Mode == config.ModeHash,
+		ch.Mode == config.ModeLowestLatency:
+		// valid
+	default:
+		panic("peer: invalid delivery mode " + strconv.Quote(ch.Mode) +
+			" for channel " + ch.Name)
+	}
+
+	return &selector{
+		mode:   ch.Mode,
+		fanout: ch.Fanout,
+		prefix: ch.HashPrefix,
+		local:  local,
+		table:  table,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// nearest returns the peers of the region of s with the lowest latency
+// estimate. The local region has no latency; regions without estimates rank
+// last.
+func (sel *selector) nearest(s *snapshot) (nearest []*target) {
+	var (
+		best  time.Duration
+		known bool
+	)
+
+	for region, targets := range s.regions {
+		rtt, ok := time.Duration(0), region == sel.local
+		if !ok && sel.table != nil {
+			rtt, ok = sel.table.Estimate(region)
+		}
+
+		switch {
+		case nearest == nil,
+			ok && !known,
+			ok == known && rtt < best:
+			nearest, best, known = targets, rtt, ok
+		}
+	}
+
+	return
+}
+
+// pick returns the peers of the given packet. nearest holds the candidates of
+// ModeLowestLatency.
+func (sel *selector) pick(s *snapshot, nearest []*target, pkt *Packet, dst []*target) []*target {
+	switch sel.mode {
+	case config.ModeHash:
+		key := pkt.Key
+		if sel.prefix > 0 && len(key) > sel.prefix {
+			key = key[:sel.prefix]
+		}
+
+		return append(dst, s.lookup(hash(key)))
+	case config.ModeLowestLatency:
+		return append(dst, nearest[sel.intn(len(nearest))])
+	default: // config.ModeRandom, since newSelector validates the mode
+		return sel.random(s, dst)
+	}
+}
+
+// random appends to dst the fanout distinct random peers of s.
+func (sel *selector) random(s *snapshot, dst []*target) []*target {
+	k := sel.fanout
+	if k >= len(s.targets) {
+		return append(dst, s.targets...)
+	}
+
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+
+	idx := sel.rnd.Perm(len(s.targets))
+	for _, i := range idx[:k] {
+		dst = append(dst, s.targets[i])
+	}
+
+	return dst
+}
+
+func (sel *selector) intn(n int) int {
+	if n == 1 {
+		return 0
+	}
+
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+
+	return sel.rnd.Intn(n)
+}
@@ -0,0 +1,140 @@
+package peer
+
+import (
+	"context"
+	"net"
+	"sort"
+
+	"github.com/azazeal/flycast/internal/discovery"
+	"github.com/azazeal/flycast/internal/latency"
+)
+
+// nearest wraps the state of the Lists which target the local region along
+// with the regions nearest to it.
+type nearest struct {
+	n     int
+	local string
+	table *latency.Table
+}
+
+// probing wraps the state of the Lists which probe the latency to remote
+// regions; those which target the nearest regions, or deliver to the peers of
+// the region with the lowest latency.
+type probing struct {
+	local  string
+	prober *latency.Prober // nil when probing is disabled
+	next   int             // the index of the region to probe next
+}
+
+// nearestRegions returns the local region along with the regions nearest to
+// it, probing one of the regions in the process.
+func (l *List) nearestRegions(ctx context.Context) ([]string, error) {
+	all, err := l.listRegions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	l.probe(ctx, all)
+
+	return l.near.table.Nearest(l.near.local, all, l.near.n), nil
+}
+
+// listRegions returns the regions instances run in.
+func (l *List) listRegions(ctx context.Context) ([]string, error) {
+	if rl, ok := l.disc.(discovery.RegionLister); ok {
+		return rl.Regions(ctx)
+	}
+
+	insts, err := l.disc.Discover(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return regionsOf(insts), nil
+}
+
+// regionsOf returns the sorted, distinct regions of the given instances.
+func regionsOf(insts []discovery.Instance) (regions []string) {
+	seen := make(map[string]struct{})
+	for _, inst := range insts {
+		if _, dup := seen[inst.Region]; !dup && inst.Region != "" {
+			seen[inst.Region] = struct{}{}
+			regions = append(regions, inst.Region)
+		}
+	}
+	sort.Strings(regions)
+
+	return
+}
+
+// probe pings an instance of the next of the given remote regions, both
+// picked in round robin order.
+func (l *List) probe(ctx context.Context, regions []string) {
+	region, ok := l.nextProbe(regions)
+	if !ok {
+		return
+	}
+
+	if insts, err := l.disc.Discover(ctx, region); err == nil {
+		l.ping(region, insts)
+	}
+}
+
+// probeInstances pings one of the given instances of the next of their remote
+// regions, both picked in round robin order.
+func (l *List) probeInstances(insts []discovery.Instance) {
+	region, ok := l.nextProbe(regionsOf(insts))
+	if !ok {
+		return
+	}
+
+	var candidates []discovery.Instance
+	for _, inst := range insts {
+		if inst.Region == region {
+			candidates = append(candidates, inst)
+		}
+	}
+	l.ping(region, candidates)
+}
+
+// nextProbe returns the next of the given regions to probe, skipping the local
+// one. It reports false in case l does not probe or none of the regions is
+// remote.
+func (l *List) nextProbe(regions []string) (string, bool) {
+	if l.probing == nil || l.probing.prober == nil {
+		return "", false
+	}
+
+	var remote []string
+	for _, r := range regions {
+		if r != l.probing.local {
+			remote = append(remote, r)
+		}
+	}
+	if len(remote) == 0 {
+		return "", false
+	}
+
+	region := remote[l.probing.next%len(remote)]
+	l.probing.next++
+
+	return region, true
+}
+
+// ping pings one of the given instances, which run in the given region.
+func (l *List) ping(region string, insts []discovery.Instance) {
+	if len(insts) == 0 {
+		return
+	}
+
+	inst := insts[l.probing.next%len(insts)]
+	addr := &net.UDPAddr{
+		IP:   inst.IP,
+		Port: inst.Port,
+	}
+	if addr.Port == 0 {
+		addr.Port = l.port
+	}
+
+	l.probing.prober.Ping(addr, region)
+}
@@ -2,48 +2,85 @@ package peer
 
 import (
 	"context"
-	"errors"
+	"io"
 	"net"
 	"sync"
 	"time"
 
-	"github.com/azazeal/fly/dns"
 	"github.com/azazeal/health"
+	"github.com/azazeal/pause"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
 
+	"github.com/azazeal/flycast/internal/common"
 	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/discovery"
+	"github.com/azazeal/flycast/internal/latency"
 	"github.com/azazeal/flycast/internal/log"
-	"github.com/azazeal/flycast/internal/loop"
-	"github.com/azazeal/flycast/internal/region"
+	"github.com/azazeal/flycast/internal/metrics"
 )
 
-// Refresh returns a refreshing list of peers.
+// Refresh returns a refreshing list of the peers of the given channel.
 //
-// global controls whether the returned List will be refreshed with global or
-// local instances.
+// The List is refreshed every REFRESH_INTERVAL. In case REFRESH_MAX exceeds
+// it, the interval doubles, up to REFRESH_MAX, for as long as the membership
+// of the List remains unchanged.
 //
-// After ctx is done and the list has stopped being refreshed, Done will be
-// called on wg.
-func Refresh(ctx context.Context, wg *sync.WaitGroup, global bool) *List {
+// In case EXCLUDE_SELF is set, the List excludes the local instance.
+//
+// While resolutions fail, the List retains the last known good peers. Once
+// those go stale for longer than STALE_MAX, they are cleared in case
+// STALE_POLICY is set to clear.
+//
+// After ctx is done and the list has stopped being refreshed and sent to, Done
+// will be called on wg.
+func Refresh(ctx context.Context, wg *sync.WaitGroup, ch *config.Channel) *List {
 	var (
 		cfg = config.FromContext(ctx)
 
 		lst = &List{
 			logger: log.FromContext(ctx).
 				Named("peer").
-				Named(region.Alias(global)),
-			hc:     health.FromContext(ctx),
-			hcc:    region.PeerComponent(global),
-			region: region.Name(global),
-			app:    cfg.App,
-			port:   cfg.Ports.Relay,
+				Named(ch.Name),
+			hc:      health.FromContext(ctx),
+			hcc:     common.ChannelComponent(common.HCRefresh, ch.Name),
+			ch:      ch,
+			scope:   ch.Name,
+			regions: ch.Regions,
+			disc:    newDiscoverer(cfg, ch.App),
+			port:    ch.Relay,
 		}
 	)
+	lst.self = newSelf(lst.logger, cfg, ch.Relay)
+	if ch.Mode != config.ModeBroadcast {
+		lst.sel = newSelector(ch, cfg.Region, latency.FromContext(ctx))
+	}
+	if ch.Nearest > 0 {
+		lst.near = &nearest{
+			n:     ch.Nearest,
+			local: cfg.Region,
+			table: latency.FromContext(ctx),
+		}
+	}
+	if ch.Nearest > 0 || ch.Mode == config.ModeLowestLatency {
+		lst.probing = &probing{
+			local:  cfg.Region,
+			prober: latency.ProberFromContext(ctx),
+		}
+	}
+	lst.stale.max = cfg.Stale.Max
+	lst.stale.policy = cfg.Stale.Policy
+	lst.resolved = time.Now()
+	lst.staleSince.Store(lst.resolved) // nothing has been resolved yet
 
 	go func() {
 		defer wg.Done()
+		defer lst.unsubscribeAll()
+		defer lst.stop()
 
-		loop.Func(ctx, time.Second, lst.refresh)
+		lst.run(ctx, cfg.Refresh.Interval, cfg.Refresh.Max)
 	}()
 
 	return lst
@@ -51,94 +88,469 @@ func Refresh(ctx context.Context, wg *sync.WaitGroup, global bool) *List {
 
 // List is a set of peers.
 type List struct {
-	logger *zap.Logger
-	hc     *health.Check
-	hcc    string
-	app    string
-	port   int
-	region string
+	logger  *zap.Logger
+	hc      *health.Check
+	hcc     string
+	ch      *config.Channel
+	scope   string // the name of the channel
+	disc    discovery.Discoverer
+	port    int
+	regions []string // nil for all regions, unless near is set
+
+	stale struct {
+		max    time.Duration
+		policy string
+	}
+	self       *self
+	sel        *selector   // nil when the channel broadcasts
+	near       *nearest    // nil unless the channel targets the nearest regions
+	probing    *probing    // nil unless the channel probes remote regions
+	resolved   time.Time   // when the last successful resolution started
+	staleSince atomic.Time // zero while the last resolution succeeded
+
+	ps      atomic.Pointer[snapshot] // immutable once published
+	senders sync.WaitGroup
+	subs    subscribers
+}
 
-	mu sync.Mutex
-	ps peerSet
+// Channel returns the channel l is a list of the peers of.
+func (l *List) Channel() *config.Channel {
+	return l.ch
 }
 
-func (l *List) resolve(ctx context.Context) (ips []net.IP, ok bool) {
-	switch ips, err := dns.Instances(ctx, l.app, l.region); {
-	default:
+func (l *List) resolve(ctx context.Context) (insts []discovery.Instance, ttl time.Duration, ok bool) {
+	at := time.Now()
+	insts, ttl, err := l.discover(ctx)
+	metrics.ResolveDuration.WithLabelValues(l.scope).Observe(time.Since(at).Seconds())
+
+	if err != nil {
 		l.logger.Warn("failed resolving instances.",
 			zap.Error(err))
 
-		return nil, false
-	case err == nil:
-		return ips, true
-	case isNXDomain(err):
-		return nil, true
+		metrics.ResolveFailures.WithLabelValues(l.scope).Inc()
+
+		return nil, 0, false
+	}
+
+	return insts, ttl, true
+}
+
+// discover discovers the instances running in the regions of l, resolving
+// each of the regions concurrently. It also returns the minimum TTL of the
+// regions, or zero in case the discoverer of l does not report TTLs.
+func (l *List) discover(ctx context.Context) ([]discovery.Instance, time.Duration, error) {
+	regions := l.regions
+	if l.near != nil {
+		var err error
+		if regions, err = l.nearestRegions(ctx); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if len(regions) == 0 {
+		return l.discoverRegion(ctx, "")
+	}
+
+	var (
+		wg    sync.WaitGroup
+		insts = make([][]discovery.Instance, len(regions))
+		ttls  = make([]time.Duration, len(regions))
+		errs  = make([]error, len(regions))
+	)
+
+	wg.Add(len(regions))
+	for i := range regions {
+		go func(i int) {
+			defer wg.Done()
+
+			insts[i], ttls[i], errs[i] = l.discoverRegion(ctx, regions[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var (
+		all []discovery.Instance
+		ttl time.Duration
+	)
+	for i := range insts {
+		if errs[i] != nil {
+			return nil, 0, errs[i]
+		}
+		all = append(all, insts[i]...)
+
+		if t := ttls[i]; t > 0 && (ttl == 0 || t < ttl) {
+			ttl = t
+		}
+	}
+
+	return all, ttl, nil
+}
+
+// discoverRegion discovers the instances running in the given region, along
+// with their TTL in case the discoverer of l reports it.
+func (l *List) discoverRegion(ctx context.Context, region string) ([]discovery.Instance, time.Duration, error) {
+	if td, ok := l.disc.(discovery.TTLDiscoverer); ok {
+		return td.DiscoverTTL(ctx, region)
+	}
+
+	insts, err := l.disc.Discover(ctx, region)
+
+	return insts, 0, err
+}
+
+// run refreshes l until ctx is done. Refreshes are spaced by min, or by up to
+// max while the membership of l remains unchanged. When the discoverer of l
+// reports the TTL of what it resolved, refreshes are instead spaced by the
+// TTL, bounded by min and max.
+func (l *List) run(ctx context.Context, min, max time.Duration) {
+	interval := metrics.RefreshInterval.WithLabelValues(l.scope)
+
+	for p := min; ctx.Err() == nil; {
+		switch unchanged, ttl := l.refresh(ctx); {
+		case ttl > 0:
+			p = ttl
+			if p < min {
+				p = min
+			} else if p > max {
+				p = max
+			}
+		case unchanged:
+			if p <<= 1; p > max {
+				p = max
+			}
+		default:
+			p = min
+		}
+		interval.Set(p.Seconds())
+
+		pause.For(ctx, p)
 	}
 }
 
-func (l *List) refresh(ctx context.Context) {
+// refresh refreshes l and reports whether it resolved the same instances it
+// already held, along with the TTL of what it resolved, if known.
+func (l *List) refresh(ctx context.Context) (unchanged bool, ttl time.Duration) {
 	l.logger.Debug("resolving instances ...")
 
 	at := time.Now()
 
-	ips, ok := l.resolve(ctx)
+	insts, ttl, ok := l.resolve(ctx)
 	if !ok {
 		l.hc.Fail(l.hcc)
+		l.expire()
 
-		return
+		return false, 0
 	}
 	l.hc.Pass(l.hcc)
 
-	var newSet peerSet
-	if len(ips) > 0 {
-		newSet = make(peerSet, len(ips))
+	l.resolved = at
+	l.staleSince.Store(time.Time{})
+	metrics.Staleness.WithLabelValues(l.scope).Set(0)
+
+	events := l.update(insts)
+	if l.near == nil {
+		// lists which target the nearest regions probe while listing them
+		l.probeInstances(insts)
 	}
 
-	for _, ip := range ips {
-		newSet.add(ip, l.port)
+	l.logger.Debug("resolved instances.",
+		zap.Int("instances", len(insts)),
+		zap.Duration("ttl", ttl),
+		zap.Duration("elapsed", time.Since(at)))
+
+	return len(events) == 0, ttl
+}
+
+// expire applies the stale policy of l, which has failed resolving.
+func (l *List) expire() {
+	if l.staleSince.Load().IsZero() {
+		l.staleSince.Store(l.resolved)
 	}
 
-	// swap sets
-	l.mu.Lock()
-	oldSet := l.ps
-	l.ps = newSet
-	l.mu.Unlock()
+	age := l.Staleness()
+	metrics.Staleness.WithLabelValues(l.scope).Set(age.Seconds())
 
-	oldSet.empty()
+	if age <= l.stale.max || l.stale.policy != config.StaleClear || len(l.peers()) == 0 {
+		return
+	}
 
-	l.logger.Debug("resolved instances.",
-		zap.Int("instances", len(ips)),
-		zap.Duration("elapsed", time.Since(at)))
+	l.logger.Warn("clearing stale peer list.",
+		zap.Duration("age", age))
+
+	l.update(nil)
+}
+
+// Staleness returns the duration since l last resolved successfully, or zero
+// in case its last resolution succeeded.
+func (l *List) Staleness() time.Duration {
+	if since := l.staleSince.Load(); !since.IsZero() {
+		return time.Since(since)
+	}
+
+	return 0
 }
 
-// Broadcast relays the message to all of the peers in l via conn.
-func (l *List) Broadcast(conn net.PacketConn, msg []byte) {
-	var wg sync.WaitGroup
-	defer wg.Wait()
+// update publishes a new peer set consisting of the given instances and
+// returns the membership changes it published.
+func (l *List) update(insts []discovery.Instance) (events []Event) {
+	// build the new set, retaining the senders of the peers which remain
+	var (
+		oldSet = l.peers()
+		newSet = make(peerSet, len(insts))
+	)
+	for _, inst := range insts {
+		addr := &net.UDPAddr{
+			IP:   inst.IP,
+			Port: inst.Port,
+		}
+		if addr.Port == 0 {
+			addr.Port = l.port
+		}
 
-	l.mu.Lock()
-	defer l.mu.Unlock()
+		if l.self.is(addr) {
+			continue
+		}
 
-	wg.Add(len(l.ps))
-	for key := range l.ps {
-		addr := l.ps[key]
+		key := addr.String()
+		if t := oldSet[key]; t != nil && t.region == inst.Region {
+			newSet[key] = t
+		} else if newSet[key] == nil {
+			newSet[key] = l.start(key, addr, inst.Region)
 
-		go func() {
-			defer wg.Done()
+			events = append(events, l.event(Joined, key, inst.Region))
+		}
+	}
+	l.ps.Store(newSnapshot(newSet, l.ch.Mode))
+
+	metrics.Peers.WithLabelValues(l.scope).Set(float64(len(newSet)))
+	for key, t := range oldSet {
+		if newSet[key] != t {
+			t.stop()
+
+			metrics.ForgetPeer(l.scope, key, t.region)
+
+			events = append(events, l.event(Left, key, t.region))
+		}
+	}
+
+	if len(events) > 0 {
+		l.publish(events)
+	}
+
+	return events
+}
+
+func (l *List) event(typ EventType, peer, region string) Event {
+	return Event{
+		Type:    typ,
+		Channel: l.scope,
+		Peer:    peer,
+		Region:  region,
+	}
+}
+
+// peers returns the current snapshot of the peer set.
+func (l *List) peers() peerSet {
+	if s := l.ps.Load(); s != nil {
+		return s.set
+	}
+
+	return nil
+}
+
+// stop stops the senders of all the peers in l and waits for them to exit.
+func (l *List) stop() {
+	if s := l.ps.Swap(nil); s != nil {
+		for _, t := range s.set {
+			t.stop()
+		}
+	}
+	l.senders.Wait()
+}
+
+// Writer is the interface the writers Broadcast sends via implement.
+//
+// net.PacketConn implements Writer.
+type Writer interface {
+	WriteTo(p []byte, addr net.Addr) (n int, err error)
+}
+
+// BatchWriter is the interface the writers which may send multiple messages
+// per call implement.
+//
+// Both ipv4.PacketConn and ipv6.PacketConn implement the WriteBatch method of
+// BatchWriter.
+type BatchWriter interface {
+	Writer
+
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// Send queues the frames of the given packets for sending via w to the peers
+// the delivery mode of the channel of l selects; every peer, unless the
+// channel is configured otherwise. All of the frames of a packet are sent to
+// the same peers.
+//
+// The frames are copied, sent asynchronously by a sender per peer, and
+// dropped for the peers whose queue is full. Senders send in batches when w
+// implements BatchWriter.
+//
+// Send returns the number of distinct peers it targeted and the number of
+// those it dropped any of the frames for.
+func (l *List) Send(w Writer, pkts ...Packet) (peers, dropped int) {
+	s := l.ps.Load()
+	if s == nil || len(s.targets) == 0 || len(pkts) == 0 {
+		return
+	}
+
+	if l.sel == nil {
+		var items []item
+		for i := range pkts {
+			items = appendItems(items, w, pkts[i].Frames)
+		}
+
+		for _, t := range s.targets {
+			if !t.enqueue(items) {
+				dropped++
+			}
+		}
+
+		return len(s.targets), dropped
+	}
+
+	var nearest []*target
+	if l.sel.mode == config.ModeLowestLatency {
+		nearest = l.sel.nearest(s)
+	}
+
+	var (
+		targeted = make(map[*target]bool) // whether nothing was dropped
+		picked   []*target
+	)
+	for i := range pkts {
+		items := appendItems(nil, w, pkts[i].Frames)
+
+		picked = l.sel.pick(s, nearest, &pkts[i], picked[:0])
+		for _, t := range picked {
+			ok, seen := targeted[t]
+			targeted[t] = t.enqueue(items) && (ok || !seen)
+		}
+	}
+
+	for _, ok := range targeted {
+		if !ok {
+			dropped++
+		}
+	}
+
+	return len(targeted), dropped
+}
+
+// appendItems appends to dst the items of copies of msgs sent via w.
+func appendItems(dst []item, w Writer, msgs [][]byte) []item {
+	for _, msg := range msgs {
+		dst = append(dst, item{
+			w:   w,
+			msg: append([]byte(nil), msg...),
+		})
+	}
+
+	return dst
+}
 
-			l.send(conn, addr, msg)
-		}()
+// The bounds of the senders.
+const (
+	// queueSize denotes the number of messages which may be queued per peer.
+	queueSize = 1 << 10
+
+	// maxBatch denotes the maximum number of messages sent per batch.
+	maxBatch = 1 << 6
+)
+
+// item is a message queued for sending.
+type item struct {
+	w   Writer
+	msg []byte
+}
+
+// start returns a target for the given peer, the sender of which it starts.
+func (l *List) start(key string, addr *net.UDPAddr, region string) *target {
+	t := &target{
+		addr:    addr,
+		region:  region,
+		queue:   make(chan item, queueSize),
+		done:    make(chan struct{}),
+		sent:    metrics.PacketsSent.WithLabelValues(l.scope, key, region),
+		errors:  metrics.SendErrors.WithLabelValues(l.scope, key, region),
+		dropped: metrics.QueueDrops.WithLabelValues(l.scope, key, region),
+	}
+
+	l.senders.Add(1)
+	go l.sender(t)
+
+	return t
+}
+
+// sender sends the messages queued for t until t is stopped.
+func (l *List) sender(t *target) {
+	defer l.senders.Done()
+
+	var (
+		batch = make([]item, 0, maxBatch)
+		ms    = make([]ipv4.Message, 0, maxBatch)
+	)
+
+	for {
+		select {
+		case it := <-t.queue:
+			batch = append(batch, it)
+		case <-t.done:
+			return
+		}
+
+	drain:
+		for len(batch) < cap(batch) {
+			select {
+			case it := <-t.queue:
+				batch = append(batch, it)
+			default:
+				break drain
+			}
+		}
+
+		for rem := batch; len(rem) > 0; {
+			// consecutive messages queued via the same writer are sent together
+			n := 1
+			for n < len(rem) && rem[n].w == rem[0].w {
+				n++
+			}
+
+			if bw, ok := rem[0].w.(BatchWriter); ok && n > 1 {
+				ms = l.sendBatch(bw, t, rem[:n], ms[:0])
+			} else {
+				for _, it := range rem[:n] {
+					l.send(it.w, t, it.msg)
+				}
+			}
+
+			rem = rem[n:]
+		}
+
+		for i := range batch {
+			batch[i] = item{}
+		}
+		batch = batch[:0]
 	}
 }
 
-func (l *List) send(conn net.PacketConn, to *net.UDPAddr, msg []byte) {
+func (l *List) send(w Writer, to *target, msg []byte) {
 	logger := l.logger.
-		With(log.IP(to.IP)).
-		With(log.Port(to.Port)).
+		With(log.IP(to.addr.IP)).
+		With(log.Port(to.addr.Port)).
 		With(log.Data(msg))
 	logger.Debug("sending ...")
 
-	n, err := conn.WriteTo(msg, to)
+	n, err := w.WriteTo(msg, to.addr)
 	if n > 0 {
 		logger = logger.With(zap.Int("sent", n))
 	}
@@ -147,42 +559,105 @@ func (l *List) send(conn net.PacketConn, to *net.UDPAddr, msg []byte) {
 		logger.Warn("failed sending.",
 			zap.Error(err))
 
+		to.errors.Inc()
+
 		return
 	}
 
 	logger.Debug("done sending.")
+
+	to.sent.Inc()
 }
 
-type peerSet map[string]*net.UDPAddr
+// sendBatch sends the given items to the peer via w. It returns ms, which
+// it uses as scratch space.
+func (l *List) sendBatch(w BatchWriter, to *target, items []item, ms []ipv4.Message) []ipv4.Message {
+	for _, it := range items {
+		ms = append(ms, ipv4.Message{
+			Buffers: [][]byte{it.msg},
+			Addr:    to.addr,
+		})
+	}
 
-func (ps peerSet) empty() {
-	for k, a := range ps {
-		a.IP = nil
-		a.Port = 0
-		a.Zone = ""
+	for off := 0; off < len(ms); {
+		n, err := w.WriteBatch(ms[off:], 0)
+		if n < 0 {
+			n = 0
+		}
+		to.sent.Add(float64(n))
 
-		addrPool.Put(a)
+		if off += n; err == nil && n > 0 {
+			continue
+		} else if err == nil {
+			err = io.ErrShortWrite
+		}
 
-		delete(ps, k)
+		// the message at off failed
+		l.logger.Warn("failed sending.",
+			log.IP(to.addr.IP),
+			log.Port(to.addr.Port),
+			zap.Error(err))
+
+		to.errors.Inc()
+		off++
+	}
+
+	for i := range ms {
+		ms[i] = ipv4.Message{}
 	}
+
+	return ms
 }
 
-func (ps peerSet) add(ip net.IP, port int) {
-	addr := addrPool.Get().(*net.UDPAddr)
+// target wraps the properties of a peer.
+type target struct {
+	addr   *net.UDPAddr
+	region string
+	queue  chan item
+	done   chan struct{} // closed when the sender should exit
 
-	addr.IP = ip
-	addr.Port = port
+	sent    prometheus.Counter
+	errors  prometheus.Counter
+	dropped prometheus.Counter
+}
+
+// enqueue queues the given items for sending to t and reports whether none
+// of them were dropped.
+func (t *target) enqueue(items []item) (ok bool) {
+	ok = true
+
+	for _, it := range items {
+		select {
+		case t.queue <- it:
+		default:
+			t.dropped.Inc()
+
+			ok = false
+		}
+	}
 
-	ps[string(ip)] = addr
+	return
 }
 
-var addrPool = sync.Pool{
-	New: func() interface{} {
-		return new(net.UDPAddr)
-	},
+// stop stops the sender of t.
+//
+// The queue of t is never closed, since snapshots of the peer set it was
+// removed from may still be broadcast to; what remains queued is discarded.
+func (t *target) stop() {
+	close(t.done)
 }
 
-func isNXDomain(err error) bool {
-	var w *net.DNSError
-	return errors.As(err, &w) && w.IsNotFound
+type peerSet map[string]*target
+
+func newDiscoverer(cfg *config.Config, app string) discovery.Discoverer {
+	switch cfg.Discovery.Backend {
+	case discovery.BackendStatic:
+		return discovery.NewStatic(cfg.Discovery.Peers)
+	case discovery.BackendDNS:
+		return discovery.NewDNS(cfg.Discovery.DNS)
+	case discovery.BackendFile:
+		return discovery.NewFile(cfg.Discovery.File)
+	default:
+		return discovery.NewFly(app)
+	}
 }
@@ -0,0 +1,205 @@
+package peer
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
+
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/discovery"
+	"github.com/azazeal/flycast/internal/metrics"
+)
+
+// newTestList returns a List of the broadcast channel of the given name,
+// which is not refreshed.
+func newTestList(tb testing.TB, name string) *List {
+	tb.Helper()
+
+	ch := &config.Channel{
+		Name: name,
+		Mode: config.ModeBroadcast,
+	}
+
+	return &List{
+		logger: zap.NewNop(),
+		ch:     ch,
+		scope:  ch.Name,
+	}
+}
+
+// countingWriter is a Writer which counts what it is asked to write.
+type countingWriter struct {
+	n atomic.Int64
+}
+
+func (w *countingWriter) WriteTo(p []byte, _ net.Addr) (int, error) {
+	w.n.Inc()
+
+	return len(p), nil
+}
+
+// instances returns n instances, the ports of which start at the given one.
+func instances(port, n int) []discovery.Instance {
+	insts := make([]discovery.Instance, n)
+	for i := range insts {
+		insts[i] = discovery.Instance{
+			IP:     net.IPv4(127, 0, 0, 1),
+			Port:   port + i,
+			Region: "ord",
+		}
+	}
+
+	return insts
+}
+
+// TestConcurrentUpdateSend refreshes and sends to a List concurrently, and
+// stops it while it is still being sent to, so that the race detector may
+// catch any unsynchronized access to the peer set.
+func TestConcurrentUpdateSend(t *testing.T) {
+	const (
+		senders  = 8
+		duration = 200 * time.Millisecond
+	)
+
+	var (
+		l   = newTestList(t, "race")
+		w   = new(countingWriter)
+		pkt = Packet{Frames: [][]byte{[]byte("payload")}}
+
+		refreshed = make(chan struct{}) // closed to stop refreshing
+		sent      = make(chan struct{}) // closed to stop sending
+
+		updaters, sending sync.WaitGroup
+	)
+
+	updaters.Add(1)
+	go func() {
+		defer updaters.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-refreshed:
+				return
+			default:
+				// overlapping sets, so that peers both join and leave
+				l.update(instances(10000+i%7, 1+i%5))
+			}
+		}
+	}()
+
+	sending.Add(senders)
+	for i := 0; i < senders; i++ {
+		go func() {
+			defer sending.Done()
+
+			for {
+				select {
+				case <-sent:
+					return
+				default:
+					_, _ = l.Send(w, pkt, pkt)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(duration)
+
+	// the list is stopped once it is no longer refreshed, but while it is
+	// still being sent to
+	close(refreshed)
+	updaters.Wait()
+	l.stop()
+	close(sent)
+	sending.Wait()
+
+	if l.peers() != nil {
+		t.Error("the peer set survived stopping")
+	}
+	if w.n.Load() == 0 {
+		t.Error("nothing was sent")
+	}
+	if peers, _ := l.Send(w, pkt); peers != 0 {
+		t.Errorf("sent to %d peers after stopping", peers)
+	}
+}
+
+// listen returns a loopback UDP connection which discards what it reads until
+// the test ends.
+func listen(tb testing.TB) *net.UDPConn {
+	tb.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1<<16)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	return conn
+}
+
+// batchConn wraps a UDP connection so that it implements BatchWriter.
+type batchConn struct {
+	*net.UDPConn
+
+	pc *ipv4.PacketConn
+}
+
+func (bc *batchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	return bc.pc.WriteBatch(ms, flags)
+}
+
+// BenchmarkSend compares sending a batch of messages to a peer via a single
+// sendmmsg call against sending them one by one.
+func BenchmarkSend(b *testing.B) {
+	const size = 512 // of each message
+
+	var (
+		l    = newTestList(b, "bench")
+		peer = listen(b)
+		out  = listen(b)
+		w    = &batchConn{UDPConn: out, pc: ipv4.NewPacketConn(out)}
+		t    = &target{
+			addr:   peer.LocalAddr().(*net.UDPAddr),
+			sent:   metrics.PacketsSent.WithLabelValues("bench", "peer", "region"),
+			errors: metrics.SendErrors.WithLabelValues("bench", "peer", "region"),
+		}
+		items = make([]item, maxBatch)
+	)
+	for i := range items {
+		items[i] = item{w: w, msg: make([]byte, size)}
+	}
+
+	b.Run("batched", func(b *testing.B) {
+		b.SetBytes(size * maxBatch)
+
+		ms := make([]ipv4.Message, 0, maxBatch)
+		for i := 0; i < b.N; i++ {
+			ms = l.sendBatch(w, t, items, ms[:0])
+		}
+	})
+
+	b.Run("single", func(b *testing.B) {
+		b.SetBytes(size * maxBatch)
+
+		for i := 0; i < b.N; i++ {
+			for _, it := range items {
+				l.send(w, t, it.msg)
+			}
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package peer
+
+import (
+	"net"
+
+	"go.uber.org/zap"
+
+	"github.com/azazeal/flycast/internal/config"
+)
+
+// self wraps the addresses via which the local instance may be discovered.
+type self struct {
+	ips  map[string]struct{}
+	port int
+}
+
+// newSelf returns the self the given config denotes, or nil in case the local
+// instance should not be excluded from peer lists.
+//
+// The local instance is identified by the given relay port along with either
+// its private (6PN) address or any of the addresses of its interfaces.
+func newSelf(logger *zap.Logger, cfg *config.Config, port int) *self {
+	if !cfg.Self.Exclude {
+		return nil
+	}
+
+	s := &self{
+		ips:  make(map[string]struct{}),
+		port: port,
+	}
+
+	if ip := cfg.Self.PrivateIP; ip != nil {
+		s.ips[ip.String()] = struct{}{}
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logger.Warn("failed listing interface addresses.",
+			zap.Error(err))
+	}
+	for _, addr := range addrs {
+		if ipn, ok := addr.(*net.IPNet); ok {
+			s.ips[ipn.IP.String()] = struct{}{}
+		}
+	}
+
+	return s
+}
+
+// is reports whether addr denotes the local instance. It's safe to call on
+// a nil self.
+func (s *self) is(addr *net.UDPAddr) bool {
+	if s == nil || addr.Port != s.port {
+		return false
+	}
+
+	_, ok := s.ips[addr.IP.String()]
+
+	return ok
+}
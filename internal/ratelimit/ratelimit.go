@@ -0,0 +1,403 @@
+// Package ratelimit implements the token bucket rate limits of the listening
+// ports, per port and per source address.
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/metrics"
+)
+
+// The set of limits packets may be throttled by.
+const (
+	LimitSourcePackets = "source_packets"
+	LimitSourceBytes   = "source_bytes"
+	LimitPortPackets   = "port_packets"
+	LimitPortBytes     = "port_bytes"
+)
+
+const (
+	// hold denotes the duration for which a source is reported as throttled
+	// after its last throttled packet.
+	hold = 10 * time.Second
+
+	// idle denotes the duration after which sources which have sent nothing
+	// are forgotten.
+	idle = time.Minute
+
+	// sweepInterval denotes how often forgettable sources are looked for.
+	sweepInterval = 10 * time.Second
+
+	// maxSources denotes the maximum number of sources tracked per port.
+	// Sources beyond it are subject to the limits of the port alone.
+	maxSources = 1 << 16
+)
+
+// bucket implements a token bucket which admits whatever arrives while it
+// holds any tokens; the bucket goes into debt for what exceeds them, so that
+// messages larger than the burst are eventually admitted.
+type bucket struct {
+	rate   float64 // tokens per second
+	burst  float64 // capacity
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns a full bucket of the given rate and burst duration, or nil
+// in case rate is zero.
+func newBucket(rate float64, burst time.Duration, now time.Time) *bucket {
+	if rate == 0 {
+		return nil
+	}
+
+	capacity := rate * burst.Seconds()
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &bucket{
+		rate:   rate,
+		burst:  capacity,
+		tokens: capacity,
+		last:   now,
+	}
+}
+
+// ready refills b and reports whether it holds any tokens. ready is safe to
+// call on a nil bucket, which is always ready.
+func (b *bucket) ready(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	if b.tokens += b.rate * now.Sub(b.last).Seconds(); b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	return b.tokens > 0
+}
+
+// take takes n tokens out of b, which must be ready.
+func (b *bucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// state wraps the buckets of a port or source, along with its throttling.
+type state struct {
+	packets, bytes *bucket
+
+	seen         time.Time // when the last packet arrived
+	since        time.Time // when throttling started; zero unless throttled
+	last         time.Time // when the last packet was throttled
+	dropped      uint64
+	droppedBytes uint64
+}
+
+func newState(packets, bytes float64, burst time.Duration, now time.Time) *state {
+	return &state{
+		packets: newBucket(packets, burst, now),
+		bytes:   newBucket(bytes, burst, now),
+	}
+}
+
+// admit reports whether s admits a message of the given size and, when it
+// does not, which of its limits (packetsLimit or bytesLimit) throttles it.
+func (s *state) admit(now time.Time, size int, packetsLimit, bytesLimit string) (ok bool, limit string) {
+	s.seen = now
+
+	switch {
+	case !s.packets.ready(now):
+		limit = packetsLimit
+	case !s.bytes.ready(now):
+		limit = bytesLimit
+	default:
+		s.packets.take(1)
+		s.bytes.take(float64(size))
+
+		return true, ""
+	}
+
+	if !s.throttled(now) {
+		// a new throttling episode
+		s.dropped, s.droppedBytes = 0, 0
+		s.since = now
+	}
+	s.last = now
+	s.dropped++
+	s.droppedBytes += uint64(size)
+
+	return false, limit
+}
+
+// throttled reports whether s has throttled anything within the hold period.
+func (s *state) throttled(now time.Time) bool {
+	return !s.last.IsZero() && now.Sub(s.last) <= hold
+}
+
+// Limiter limits the rate of the packets arriving on a listening port, both
+// overall and per source address.
+//
+// Limiter is safe for concurrent use.
+type Limiter struct {
+	channel string
+	port    int
+	rate    config.Rate
+
+	mu      sync.Mutex
+	state   *state // of the port
+	sources map[netip.Addr]*state
+	swept   time.Time
+
+	throttled map[string]prometheus.Counter // by limit
+	tracked   prometheus.Gauge
+}
+
+func newLimiter(channel string, port int, rate config.Rate) *Limiter {
+	var (
+		now = time.Now()
+		p   = metrics.Port(port)
+	)
+
+	return &Limiter{
+		channel: channel,
+		port:    port,
+		rate:    rate,
+		state:   newState(rate.PortPackets, rate.PortBytes, rate.Burst, now),
+		sources: make(map[netip.Addr]*state),
+		swept:   now,
+		throttled: map[string]prometheus.Counter{
+			LimitSourcePackets: metrics.Throttled.WithLabelValues(p, LimitSourcePackets),
+			LimitSourceBytes:   metrics.Throttled.WithLabelValues(p, LimitSourceBytes),
+			LimitPortPackets:   metrics.Throttled.WithLabelValues(p, LimitPortPackets),
+			LimitPortBytes:     metrics.Throttled.WithLabelValues(p, LimitPortBytes),
+		},
+		tracked: metrics.RateLimitedSources.WithLabelValues(p),
+	}
+}
+
+// Admit reports whether a message of the given size, which ip sent, is within
+// the limits of l and, when it is not, which limit throttles it.
+//
+// Admit is safe to call on a nil Limiter, which admits everything.
+func (l *Limiter) Admit(ip net.IP, size int) (ok bool, limit string) {
+	if l == nil {
+		return true, ""
+	}
+
+	return l.admit(ip, size, time.Now())
+}
+
+func (l *Limiter) admit(ip net.IP, size int, now time.Time) (ok bool, limit string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	// sources are limited first, so that a throttled source does not deplete
+	// the tokens of the port
+	if s := l.source(ip, now); s != nil {
+		if ok, limit = s.admit(now, size, LimitSourcePackets, LimitSourceBytes); !ok {
+			l.throttled[limit].Inc()
+
+			return
+		}
+	}
+
+	if ok, limit = l.state.admit(now, size, LimitPortPackets, LimitPortBytes); !ok {
+		l.throttled[limit].Inc()
+	}
+
+	return
+}
+
+// source returns the state of the given source, or nil in case sources are
+// not limited or too many are tracked already.
+//
+// A full table is not swept here, since sources which arrive at a high rate
+// (i.e. spoofed ones) would otherwise have each of their packets scan it; it
+// is swept every sweepInterval instead.
+func (l *Limiter) source(ip net.IP, now time.Time) *state {
+	if l.rate.SourcePackets == 0 && l.rate.SourceBytes == 0 {
+		return nil
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	if s := l.sources[addr]; s != nil {
+		return s
+	}
+
+	if len(l.sources) >= maxSources {
+		return nil
+	}
+
+	s := newState(l.rate.SourcePackets, l.rate.SourceBytes, l.rate.Burst, now)
+	l.sources[addr] = s
+	l.tracked.Set(float64(len(l.sources)))
+
+	return s
+}
+
+// sweep forgets the sources which have been idle, and not throttled, for
+// longer than the idle period.
+func (l *Limiter) sweep(now time.Time) {
+	for addr, s := range l.sources {
+		if now.Sub(s.seen) > idle && !s.throttled(now) {
+			delete(l.sources, addr)
+		}
+	}
+	l.swept = now
+
+	l.tracked.Set(float64(len(l.sources)))
+}
+
+// Throttled wraps the properties of a throttled source.
+type Throttled struct {
+	// Channel holds the name of the channel of the port, or relay for the
+	// relay port.
+	Channel string `json:"channel"`
+
+	// Port denotes the listening port.
+	Port int `json:"port"`
+
+	// Source holds the address of the source, or * for the port itself.
+	Source string `json:"source"`
+
+	// Since denotes when the source started being throttled.
+	Since time.Time `json:"since"`
+
+	// Last denotes when the last packet of the source was throttled.
+	Last time.Time `json:"last"`
+
+	// Dropped holds the number of packets throttled since Since.
+	Dropped uint64 `json:"dropped"`
+
+	// DroppedBytes holds the number of bytes throttled since Since.
+	DroppedBytes uint64 `json:"droppedBytes"`
+}
+
+// appendThrottled appends to dst the port and sources l currently throttles.
+func (l *Limiter) appendThrottled(dst []Throttled) []Throttled {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	add := func(source string, s *state) {
+		if s.throttled(now) {
+			dst = append(dst, Throttled{
+				Channel:      l.channel,
+				Port:         l.port,
+				Source:       source,
+				Since:        s.since,
+				Last:         s.last,
+				Dropped:      s.dropped,
+				DroppedBytes: s.droppedBytes,
+			})
+		}
+	}
+
+	add("*", l.state)
+	for addr, s := range l.sources {
+		add(addr.String(), s)
+	}
+
+	return dst
+}
+
+// Registry holds the Limiters of the listening ports.
+//
+// Registry is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	limiters map[int]*Limiter // by port
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		limiters: make(map[int]*Limiter),
+	}
+}
+
+// Limiter returns the Limiter of the given port of the named channel, which
+// applies the given limits, or nil in case they limit nothing. The Limiter of
+// a port is created on first use and shared by whatever accepts packets for
+// the port thereafter.
+//
+// Limiter is safe to call on a nil Registry, in which case it returns nil.
+func (r *Registry) Limiter(channel string, port int, rate config.Rate) *Limiter {
+	if r == nil || !rate.Limited() {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l := r.limiters[port]
+	if l == nil {
+		l = newLimiter(channel, port, rate)
+		r.limiters[port] = l
+	}
+
+	return l
+}
+
+// Throttled returns the ports and sources which are currently throttled,
+// ordered by the number of packets dropped. Throttled is safe to call on a nil
+// Registry.
+func (r *Registry) Throttled() []Throttled {
+	ret := []Throttled{}
+	if r == nil {
+		return ret
+	}
+
+	r.mu.Lock()
+	limiters := make([]*Limiter, 0, len(r.limiters))
+	for _, l := range r.limiters {
+		limiters = append(limiters, l)
+	}
+	r.mu.Unlock()
+
+	for _, l := range limiters {
+		ret = l.appendThrottled(ret)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Dropped > ret[j].Dropped
+	})
+
+	return ret
+}
+
+type contextKeyType struct{}
+
+// FromContext returns the Registry the given Context carries, or nil in case
+// it carries none.
+func FromContext(ctx context.Context) *Registry {
+	r, _ := ctx.Value(contextKeyType{}).(*Registry)
+
+	return r
+}
+
+// NewContext returns a copy of ctx which carries r.
+func NewContext(ctx context.Context, r *Registry) context.Context {
+	return context.WithValue(ctx, contextKeyType{}, r)
+}
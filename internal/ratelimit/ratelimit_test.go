@@ -0,0 +1,244 @@
+package ratelimit
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/azazeal/flycast/internal/config"
+)
+
+var epoch = time.Date(2022, 5, 9, 12, 0, 0, 0, time.UTC)
+
+func TestBucket(t *testing.T) {
+	type step struct {
+		at    time.Duration // since epoch
+		take  float64       // when ready
+		ready bool
+	}
+
+	cases := []struct {
+		name  string
+		rate  float64
+		burst time.Duration
+		steps []step
+	}{
+		{
+			name:  "burst",
+			rate:  10,
+			burst: time.Second,
+			steps: []step{
+				{0, 5, true},
+				{0, 5, true},
+				{0, 0, false},
+			},
+		},
+		{
+			name:  "debt",
+			rate:  10,
+			burst: time.Second,
+			steps: []step{
+				{0, 25, true},                                   // 15 short
+				{time.Second, 0, false},                         // 5 short
+				{2 * time.Second, 0, true},                      // 5 over
+				{2 * time.Second, 6, true},                      // 1 short
+				{2*time.Second + 50*time.Millisecond, 0, false}, // 0.5 short
+			},
+		},
+		{
+			name:  "refill is capped",
+			rate:  10,
+			burst: time.Second,
+			steps: []step{
+				{0, 10, true},
+				{time.Hour, 10, true},
+				{time.Hour, 0, false},
+			},
+		},
+		{
+			name:  "capacity of at least one",
+			rate:  1,
+			burst: time.Millisecond,
+			steps: []step{
+				{0, 1, true},
+				{0, 0, false},
+				{time.Second, 0, true},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			b := newBucket(c.rate, c.burst, epoch)
+
+			for i, s := range c.steps {
+				if ready := b.ready(epoch.Add(s.at)); ready != s.ready {
+					t.Fatalf("step %d: expected ready to be %t, holding %g tokens", i, s.ready, b.tokens)
+				}
+				if s.ready {
+					b.take(s.take)
+				}
+			}
+		})
+	}
+}
+
+func TestNilBucket(t *testing.T) {
+	var b *bucket
+	if b = newBucket(0, time.Second, epoch); b != nil {
+		t.Fatal("a zero rate yielded a bucket")
+	}
+
+	b.take(1 << 20)
+	if !b.ready(epoch) {
+		t.Error("a nil bucket is not ready")
+	}
+}
+
+func TestHold(t *testing.T) {
+	s := newState(1, 0, time.Second, epoch)
+
+	cases := []struct {
+		at        time.Duration // since epoch
+		admitted  bool
+		throttled bool // after admitting
+		since     time.Duration
+		dropped   uint64
+	}{
+		{0, true, false, 0, 0},
+		{0, false, true, 0, 1},
+		{0, false, true, 0, 2},
+		// the episode lasts for as long as packets are throttled within hold
+		{hold, true, true, 0, 2},
+		{hold, false, true, 0, 3},
+		// a new episode starts once hold has passed without throttling
+		{2*hold + time.Millisecond, true, false, 0, 3},
+		{2*hold + time.Millisecond, false, true, 2*hold + time.Millisecond, 1},
+	}
+
+	for i, c := range cases {
+		now := epoch.Add(c.at)
+
+		ok, limit := s.admit(now, 1, LimitSourcePackets, LimitSourceBytes)
+		switch {
+		case ok != c.admitted:
+			t.Fatalf("step %d: expected admitted to be %t", i, c.admitted)
+		case !ok && limit != LimitSourcePackets:
+			t.Fatalf("step %d: throttled by %q", i, limit)
+		case s.throttled(now) != c.throttled:
+			t.Fatalf("step %d: expected throttled to be %t", i, c.throttled)
+		case s.dropped != c.dropped:
+			t.Fatalf("step %d: expected %d dropped, got %d", i, c.dropped, s.dropped)
+		case c.throttled && !s.since.Equal(epoch.Add(c.since)):
+			t.Fatalf("step %d: expected the episode to start at %s, got %s", i, c.since, s.since.Sub(epoch))
+		}
+	}
+}
+
+// fill fills the source table of l with idle sources, last seen at the given
+// time.
+func fill(l *Limiter, seen time.Time) {
+	for i := 0; len(l.sources) < maxSources; i++ {
+		addr := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+
+		s := newState(l.rate.SourcePackets, l.rate.SourceBytes, l.rate.Burst, seen)
+		s.seen = seen
+		l.sources[addr] = s
+	}
+}
+
+func TestFullTable(t *testing.T) {
+	rate := config.Rate{
+		SourcePackets: 1,
+		PortPackets:   3,
+		Burst:         time.Second,
+	}
+
+	var (
+		l   = newLimiter("full", 1, rate)
+		now = l.swept
+		ip  = net.IPv4(192, 0, 2, 1)
+	)
+	fill(l, now)
+
+	// the source is not tracked, and is subject to the port limits alone
+	for i := 0; i < 3; i++ {
+		if ok, limit := l.admit(ip, 1, now); !ok {
+			t.Fatalf("packet %d of an untracked source was throttled by %q", i, limit)
+		}
+	}
+	if ok, limit := l.admit(ip, 1, now); ok || limit != LimitPortPackets {
+		t.Fatalf("expected the port limit to apply, got %t and %q", ok, limit)
+	}
+	if len(l.sources) != maxSources {
+		t.Fatalf("%d sources are tracked", len(l.sources))
+	}
+
+	// idle sources are forgotten on the next sweep, which makes room
+	later := now.Add(idle + sweepInterval)
+	if ok, limit := l.admit(ip, 1, later); !ok {
+		t.Fatalf("throttled by %q after the sweep", limit)
+	}
+	if len(l.sources) != 1 {
+		t.Fatalf("expected 1 tracked source after the sweep, got %d", len(l.sources))
+	}
+	if ok, limit := l.admit(ip, 1, later); ok || limit != LimitSourcePackets {
+		t.Fatalf("expected the source limit to apply, got %t and %q", ok, limit)
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	var (
+		r    = NewRegistry()
+		rate = config.Rate{
+			SourcePackets: 1,
+			PortPackets:   4,
+			Burst:         time.Second,
+		}
+		now = time.Now()
+
+		a = r.Limiter("a", 1, rate)
+		b = r.Limiter("b", 2, config.Rate{PortPackets: 4, Burst: time.Second})
+	)
+
+	if r.Limiter("a", 1, rate) != a {
+		t.Fatal("the limiter of a port is not shared")
+	}
+	if r.Limiter("c", 3, config.Rate{Burst: time.Second}) != nil {
+		t.Fatal("a port which is not limited has a limiter")
+	}
+
+	admit := func(l *Limiter, ip net.IP, n int) {
+		for i := 0; i < n; i++ {
+			_, _ = l.admit(ip, 1, now)
+		}
+	}
+	admit(a, net.IPv4(192, 0, 2, 1), 3)  // 2 dropped by the source
+	admit(a, net.IPv4(192, 0, 2, 2), 1)  // none dropped
+	admit(b, net.IPv4(192, 0, 2, 1), 10) // 6 dropped by the port
+
+	expected := []struct {
+		channel, source string
+		dropped         uint64
+	}{
+		{"b", "*", 6},
+		{"a", "192.0.2.1", 2},
+	}
+
+	got := r.Throttled()
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d throttled, got %+v", len(expected), got)
+	}
+	for i, e := range expected {
+		if g := got[i]; g.Channel != e.channel || g.Source != e.source || g.Dropped != e.dropped {
+			t.Errorf("%d: expected %+v, got %+v", i, e, g)
+		}
+	}
+
+	var nilRegistry *Registry
+	if th := nilRegistry.Throttled(); th == nil || len(th) != 0 {
+		t.Errorf("a nil registry reported %v", th)
+	}
+}
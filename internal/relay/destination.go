@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"errors"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/metrics"
+)
+
+// errFull is returned when delivering to a destination whose receive queue is
+// full.
+var errFull = errors.New("destination queue full")
+
+// destination wraps a local destination relayed packets are delivered to.
+type destination struct {
+	config.Destination
+
+	udp  *net.UDPAddr // set for UDP destinations
+	conn net.Conn     // lazily dialed for Unix datagram socket destinations
+
+	delivered prometheus.Counter
+	failed    prometheus.Counter
+	dropped   prometheus.Counter
+}
+
+func newDestinations(cfgs []config.Destination) []*destination {
+	dsts := make([]*destination, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		d := &destination{
+			Destination: cfg,
+			delivered:   metrics.Deliveries.WithLabelValues(cfg.String(), "delivered"),
+			failed:      metrics.Deliveries.WithLabelValues(cfg.String(), "failed"),
+			dropped:     metrics.Deliveries.WithLabelValues(cfg.String(), "dropped"),
+		}
+
+		if cfg.Network == config.NetworkUDP {
+			// the address has already been validated by the config loader
+			d.udp, _ = net.ResolveUDPAddr(cfg.Network, cfg.Addr)
+		}
+
+		dsts = append(dsts, d)
+	}
+
+	return dsts
+}
+
+// deliver delivers msg to d. UDP destinations are delivered to via pc.
+//
+// Writes to Unix datagram socket destinations do not block; deliver returns
+// errFull when the receive queue of the destination is full, so that a stuck
+// destination does not stall the relay port.
+func (d *destination) deliver(pc net.PacketConn, msg []byte) (err error) {
+	if d.udp != nil {
+		_, err = pc.WriteTo(msg, d.udp)
+
+		return
+	}
+
+	if d.conn == nil {
+		if d.conn, err = net.Dial(d.Network, d.Addr); err != nil {
+			return
+		}
+	}
+
+	if err = tryWrite(d.conn, msg); err != nil && err != errFull {
+		_ = d.conn.Close()
+		d.conn = nil
+	}
+
+	return
+}
+
+func (d *destination) close() {
+	if d.conn != nil {
+		_ = d.conn.Close()
+		d.conn = nil
+	}
+}
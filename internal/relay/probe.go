@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/azazeal/health"
+	"go.uber.org/zap"
+
+	"github.com/azazeal/flycast/internal/acl"
+	"github.com/azazeal/flycast/internal/auth"
+	"github.com/azazeal/flycast/internal/buffer"
+	"github.com/azazeal/flycast/internal/common"
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/latency"
+	"github.com/azazeal/flycast/internal/log"
+	"github.com/azazeal/flycast/internal/loop"
+	"github.com/azazeal/flycast/internal/metrics"
+	"github.com/azazeal/flycast/internal/ratelimit"
+)
+
+// answer starts a goroutine which, for as long as ctx is not done, answers on
+// the probe port the latency probes other flycast instances send. Probes are
+// subject to the given rules and, in case kr is not nil, authenticated like
+// relayed packets are.
+//
+// Since the probe port carries nothing but probes, relayed packets are never
+// mistaken for them.
+//
+// When ctx is done and the answering has stopped, Done will be called on wg.
+func answer(ctx context.Context, wg *sync.WaitGroup, kr *auth.Keyring, rules *acl.Rules) {
+	var (
+		logger  = log.FromContext(ctx).Named("pong")
+		cfg     = config.FromContext(ctx)
+		hc      = health.FromContext(ctx)
+		port    = metrics.Port(cfg.Ports.Probe)
+		limiter = ratelimit.FromContext(ctx).Limiter("probe", cfg.Ports.Probe, cfg.RelayRate)
+	)
+
+	go func() {
+		defer wg.Done()
+
+		loop.Func(ctx, time.Second, func(ctx context.Context) {
+			defer hc.Fail(common.HCPong)
+
+			conn := bind(logger, cfg.Ports.Probe)
+			if conn == nil {
+				return
+			}
+			hc.Pass(common.HCPong)
+
+			buf := buffer.Get()
+			defer buffer.Put(buf)
+
+			r := &receiver{
+				logger: logger,
+				conn:   conn,
+				auth:   kr,
+				rules:  rules,
+				limit:  limiter,
+				buf:    buf,
+
+				denied:     metrics.Rejected.WithLabelValues(port, acl.RuleDeny),
+				disallowed: metrics.Rejected.WithLabelValues(port, acl.RuleAllow),
+			}
+			run(ctx, r, r.pong)
+		})
+	}()
+}
+
+// pong answers the ping pkt carries with a pong, which it signs in case r
+// authenticates. Packets which carry no ping are dropped.
+func (r *receiver) pong(from net.Addr, pkt []byte) {
+	if !r.admit(from, len(pkt)) {
+		return
+	}
+
+	pkt, ok := r.auth.Verify(auth.TypeRelay, pkt)
+	if !ok {
+		r.logger.Debug("dropped unauthenticated probe.",
+			log.Addr(from))
+
+		return
+	}
+
+	pong, ok := latency.Pong(pkt)
+	if !ok {
+		r.logger.Debug("dropped packet which is not a probe.",
+			log.Addr(from))
+
+		return
+	}
+
+	if _, err := r.conn.WriteTo(r.auth.Sign(auth.TypeReply, pong), from); err != nil {
+		r.logger.Debug("failed answering probe.",
+			log.Addr(from),
+			zap.Error(err))
+
+		return
+	}
+
+	metrics.ProbesAnswered.Inc()
+}
@@ -0,0 +1,324 @@
+// Package relay implements the receiving side of flycast-to-flycast relaying.
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/azazeal/health"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/azazeal/flycast/internal/acl"
+	"github.com/azazeal/flycast/internal/auth"
+	"github.com/azazeal/flycast/internal/buffer"
+	"github.com/azazeal/flycast/internal/common"
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/dedup"
+	"github.com/azazeal/flycast/internal/fragment"
+	"github.com/azazeal/flycast/internal/log"
+	"github.com/azazeal/flycast/internal/loop"
+	"github.com/azazeal/flycast/internal/metrics"
+	"github.com/azazeal/flycast/internal/ratelimit"
+	"github.com/azazeal/flycast/internal/reliable"
+	"github.com/azazeal/flycast/internal/seal"
+)
+
+// minWindow denotes the minimum duration for which received reliable frames
+// are remembered.
+const minWindow = time.Minute
+
+// window returns the duration for which received reliable frames are
+// remembered, which covers twice the retransmission deadline so that frames
+// retransmitted up to it, by instances which share it, are delivered only
+// once.
+func window(deadline time.Duration) time.Duration {
+	if w := deadline << 1; w > minWindow {
+		return w
+	}
+
+	return minWindow
+}
+
+// The set of exported counters.
+var (
+	accepted   = metrics.RelayPackets.WithLabelValues("accepted")
+	duplicates = metrics.RelayPackets.WithLabelValues("duplicate")
+)
+
+// Receive starts a goroutine which, for as long as ctx is not done, receives
+// on the relay port the packets other flycast instances relay and delivers
+// them to each of the configured local destinations.
+//
+// Packets from the sources the relay rules reject, or in excess of the relay
+// rate limits, are dropped. Reliable frames are acknowledged and delivered
+// only once. The latency probes of other flycast instances are answered on
+// the probe port, which the relay rules and rate limits apply to as well.
+//
+// When ctx is done and the receiving has stopped, Done will be called on wg.
+func Receive(ctx context.Context, wg *sync.WaitGroup) {
+	var (
+		logger = log.FromContext(ctx).Named("relay")
+		cfg    = config.FromContext(ctx)
+		hc     = health.FromContext(ctx)
+		seen   = dedup.New[reliable.Header](window(cfg.Reliable.Deadline))
+		frags  = fragment.NewReassembler()
+		dsts   = newDestinations(cfg.Deliver)
+		kr     *auth.Keyring
+		sealer = seal.FromContext(ctx)
+		port   = metrics.Port(cfg.Ports.Relay)
+	)
+	if cfg.Auth.Relay {
+		kr = auth.FromContext(ctx)
+	}
+
+	wg.Add(1)
+	rules := acl.Refresh(ctx, wg, logger, &cfg.ACL.Relay)
+	limiter := ratelimit.FromContext(ctx).Limiter("relay", cfg.Ports.Relay, cfg.RelayRate)
+
+	wg.Add(1)
+	answer(ctx, wg, kr, rules)
+
+	go func() {
+		defer wg.Done()
+		defer func() {
+			for _, d := range dsts {
+				d.close()
+			}
+		}()
+
+		loop.Func(ctx, time.Second, func(ctx context.Context) {
+			defer hc.Fail(common.HCRelay)
+
+			conn := bind(logger, cfg.Ports.Relay)
+			if conn == nil {
+				return
+			}
+			hc.Pass(common.HCRelay)
+
+			buf := buffer.Get()
+			defer buffer.Put(buf)
+
+			r := &receiver{
+				logger: logger,
+				conn:   conn,
+				dsts:   dsts,
+				seen:   seen,
+				frags:  frags,
+				auth:   kr,
+				seal:   sealer,
+				rules:  rules,
+				limit:  limiter,
+				buf:    buf,
+
+				denied:     metrics.Rejected.WithLabelValues(port, acl.RuleDeny),
+				disallowed: metrics.Rejected.WithLabelValues(port, acl.RuleAllow),
+			}
+			run(ctx, r, r.receive)
+		})
+	}()
+}
+
+func bind(logger *zap.Logger, port int) net.PacketConn {
+	logger = logger.With(log.Port(port))
+	logger.Info("binding ...")
+
+	l, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		logger.Warn("failed binding.",
+			zap.Error(err))
+
+		metrics.BindRetries.WithLabelValues(metrics.Port(port)).Inc()
+
+		return nil
+	}
+	logger.Debug("bound.")
+
+	return l
+}
+
+type receiver struct {
+	logger *zap.Logger
+	conn   net.PacketConn
+	dsts   []*destination
+	seen   *dedup.Window[reliable.Header]
+	frags  *fragment.Reassembler
+	auth   *auth.Keyring      // nil unless relayed packets are authenticated
+	seal   *seal.Sealer       // nil unless relayed packets are encrypted
+	rules  *acl.Rules         // nil unless sources are restricted
+	limit  *ratelimit.Limiter // nil unless rates are limited
+	buf    *buffer.Buffer
+
+	denied     prometheus.Counter
+	disallowed prometheus.Counter
+}
+
+// run passes the packets r reads to handle until ctx is done or reading
+// fails.
+func run(ctx context.Context, r *receiver, handle func(from net.Addr, pkt []byte)) {
+	exited := make(chan struct{})
+	defer close(exited)
+
+	closer := common.CloseOnce(r.conn)
+	defer closer.Close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		select {
+		case <-ctx.Done():
+			_ = closer.Close()
+		case <-exited:
+			break
+		}
+	}()
+
+	for {
+		n, addr, err := r.conn.ReadFrom(r.buf[:])
+		if err != nil {
+			if ctx.Err() == nil {
+				r.logger.Warn("failed reading.",
+					zap.Error(err))
+			}
+
+			return
+		}
+
+		handle(addr, r.buf[:n])
+	}
+}
+
+// receive delivers the message pkt carries, in case r accepts it.
+func (r *receiver) receive(from net.Addr, pkt []byte) {
+	if msg, ok := r.accept(from, pkt); ok {
+		r.deliver(msg)
+	}
+}
+
+// accept returns the message pkt carries. It reports false for the packets
+// the rules and rate limits of r reject, for those which fail authentication,
+// in case r authenticates, for the reliable frames it has already accepted and
+// for fragments which do not complete a message.
+//
+// Reliable frames are acknowledged and remembered only once authenticated,
+// since the tag covers their header; so are the acknowledgements r signs.
+func (r *receiver) accept(from net.Addr, pkt []byte) ([]byte, bool) {
+	if !r.admit(from, len(pkt)) {
+		return nil, false
+	}
+
+	pkt, ok := r.auth.Verify(auth.TypeRelay, pkt)
+	if !ok {
+		r.logger.Debug("dropped unauthenticated packet.",
+			log.Addr(from))
+
+		return nil, false
+	}
+
+	h, msg, ok := reliable.ParseData(pkt)
+	if !ok {
+		return r.reassemble(from, pkt)
+	}
+
+	if _, err := r.conn.WriteTo(r.auth.Sign(auth.TypeReply, reliable.Ack(h)), from); err != nil {
+		r.logger.Warn("failed acknowledging.",
+			log.Addr(from),
+			zap.Error(err))
+	}
+
+	if !r.seen.Admit(h) {
+		duplicates.Inc()
+
+		return nil, false
+	}
+
+	return r.reassemble(from, msg)
+}
+
+// admit reports whether the rules and rate limits of r admit a packet of the
+// given size from the given source.
+func (r *receiver) admit(from net.Addr, size int) bool {
+	var ip net.IP
+	if addr, ok := from.(*net.UDPAddr); ok {
+		ip = addr.IP
+	}
+
+	if ok, rule := r.rules.Admit(ip); !ok {
+		if rule == acl.RuleDeny {
+			r.denied.Inc()
+		} else {
+			r.disallowed.Inc()
+		}
+
+		r.logger.Debug("rejected packet.",
+			log.IP(ip),
+			zap.String("rule", rule))
+
+		return false
+	}
+
+	if ok, limit := r.limit.Admit(ip, size); !ok {
+		r.logger.Debug("throttled packet.",
+			log.IP(ip),
+			zap.String("limit", limit))
+
+		return false
+	}
+
+	return true
+}
+
+// reassemble adds the given frame to the message it is a fragment of. Complete
+// messages are decrypted, in case r decrypts.
+func (r *receiver) reassemble(from net.Addr, frame []byte) ([]byte, bool) {
+	msg, ok := r.frags.Add(from.String(), frame)
+	if !ok {
+		return nil, false
+	}
+
+	if msg, ok = r.seal.Open(msg); !ok {
+		r.logger.Debug("dropped undecryptable packet.",
+			log.Addr(from))
+	}
+
+	return msg, ok
+}
+
+func (r *receiver) deliver(msg []byte) {
+	accepted.Inc()
+
+	for _, d := range r.dsts {
+		logger := r.logger.With(
+			zap.Stringer("destination", d),
+			log.Data(msg))
+
+		switch err := d.deliver(r.conn, msg); {
+		case errors.Is(err, errFull):
+			logger.Debug("dropped delivery.",
+				zap.Error(err))
+
+			d.dropped.Inc()
+
+			continue
+		case err != nil:
+			logger.Warn("failed delivering.",
+				zap.Error(err))
+
+			d.failed.Inc()
+
+			continue
+		}
+
+		logger.Debug("delivered.")
+
+		d.delivered.Inc()
+	}
+}
@@ -0,0 +1,30 @@
+package relay
+
+import (
+	"net"
+	"syscall"
+)
+
+// tryWrite writes msg to conn without blocking. It returns errFull in case the
+// write would block.
+func tryWrite(conn net.Conn, msg []byte) error {
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var werr error
+	if err := rc.Write(func(fd uintptr) bool {
+		_, werr = syscall.Write(int(fd), msg)
+
+		return true // never wait for the socket to become writable
+	}); err != nil {
+		return err
+	}
+
+	if werr == syscall.EAGAIN {
+		return errFull
+	}
+
+	return werr
+}
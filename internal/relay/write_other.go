@@ -0,0 +1,29 @@
+//go:build !linux
+
+package relay
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// writeTimeout denotes how long writes may block for before they are
+// abandoned.
+const writeTimeout = 10 * time.Millisecond
+
+// tryWrite writes msg to conn, blocking for up to writeTimeout. It returns
+// errFull in case the write times out.
+func tryWrite(conn net.Conn, msg []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+
+	_, err := conn.Write(msg)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return errFull
+	}
+
+	return err
+}
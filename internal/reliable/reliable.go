@@ -0,0 +1,85 @@
+// Package reliable implements reliable delivery between flycast instances via
+// sequenced frames, acknowledgements and retransmissions.
+package reliable
+
+import (
+	"context"
+	"encoding/binary"
+)
+
+// HeaderSize denotes the size of the frame header.
+const HeaderSize = 21
+
+// magic is the wire prefix of reliable frames.
+var magic = [...]byte{'f', 'c', 'r', 1}
+
+// The set of frame types.
+const (
+	typeData byte = iota + 1
+	typeAck
+)
+
+// Header wraps the properties of the frame header.
+type Header struct {
+	// Sender identifies the Sender of the frame.
+	Sender uint64
+
+	// Seq denotes the sequence number of the frame.
+	Seq uint64
+}
+
+func encode(typ byte, h Header, payload []byte) []byte {
+	b := make([]byte, HeaderSize+len(payload))
+
+	copy(b, magic[:])
+	b[4] = typ
+	binary.BigEndian.PutUint64(b[5:], h.Sender)
+	binary.BigEndian.PutUint64(b[13:], h.Seq)
+	copy(b[HeaderSize:], payload)
+
+	return b
+}
+
+func parse(b []byte) (typ byte, h Header, payload []byte, ok bool) {
+	if len(b) < HeaderSize || string(b[:len(magic)]) != string(magic[:]) {
+		return
+	}
+
+	typ = b[4]
+	h.Sender = binary.BigEndian.Uint64(b[5:])
+	h.Seq = binary.BigEndian.Uint64(b[13:])
+
+	return typ, h, b[HeaderSize:], true
+}
+
+// ParseData parses the data frame b carries. It reports false in case b
+// carries no data frame.
+func ParseData(b []byte) (h Header, payload []byte, ok bool) {
+	var typ byte
+	if typ, h, payload, ok = parse(b); typ != typeData {
+		ok = false
+	}
+
+	return
+}
+
+// Ack returns the frame which acknowledges the data frame with the given
+// header.
+func Ack(h Header) []byte {
+	return encode(typeAck, h, nil)
+}
+
+type contextKeyType struct{}
+
+// FromContext returns the Sender the given Context carries, or nil in case it
+// carries none.
+func FromContext(ctx context.Context) *Sender {
+	s, _ := ctx.Value(contextKeyType{}).(*Sender)
+
+	return s
+}
+
+// NewContext returns a copy of ctx which carries s.
+func NewContext(ctx context.Context, s *Sender) context.Context {
+	return context.WithValue(ctx, contextKeyType{}, s)
+}
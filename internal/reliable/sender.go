@@ -0,0 +1,300 @@
+package reliable
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/azazeal/health"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+
+	"github.com/azazeal/flycast/internal/auth"
+	"github.com/azazeal/flycast/internal/buffer"
+	"github.com/azazeal/flycast/internal/common"
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/log"
+	"github.com/azazeal/flycast/internal/loop"
+	"github.com/azazeal/flycast/internal/metrics"
+)
+
+// The bounds of the retransmission backoff.
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = time.Second
+)
+
+var errNotBound = errors.New("reliable: sender not bound")
+
+// The set of exported counters.
+var (
+	sent          = metrics.ReliableFrames.WithLabelValues("sent")
+	retransmitted = metrics.ReliableFrames.WithLabelValues("retransmitted")
+	acknowledged  = metrics.ReliableFrames.WithLabelValues("acknowledged")
+	lost          = metrics.ReliableFrames.WithLabelValues("lost")
+)
+
+// Send returns a Sender which, for as long as ctx is not done, retransmits the
+// frames it sends until they're acknowledged or their deadline passes.
+//
+// In case relayed packets are authenticated, the Sender signs each
+// transmission of its frames, header included, and accepts only signed
+// acknowledgements.
+//
+// When ctx is done and the Sender has stopped, Done will be called on wg.
+func Send(ctx context.Context, wg *sync.WaitGroup) *Sender {
+	var (
+		cfg = config.FromContext(ctx)
+		hc  = health.FromContext(ctx)
+
+		s = &Sender{
+			logger:   log.FromContext(ctx).Named("reliable"),
+			id:       randomID(),
+			deadline: cfg.Reliable.Deadline,
+			pending:  make(map[key]*pending),
+		}
+	)
+	if cfg.Auth.Relay {
+		s.auth = auth.FromContext(ctx)
+	}
+
+	go func() {
+		defer wg.Done()
+		defer s.abandon()
+
+		loop.Func(ctx, time.Second, func(ctx context.Context) {
+			defer hc.Fail(common.HCReliable)
+
+			conn := bind(s.logger)
+			if conn == nil {
+				return
+			}
+			hc.Pass(common.HCReliable)
+
+			s.setConn(conn)
+			defer s.setConn(nil)
+
+			s.run(ctx, conn)
+		})
+	}()
+
+	return s
+}
+
+// Sender implements reliable sending.
+type Sender struct {
+	logger   *zap.Logger
+	id       uint64
+	seq      atomic.Uint64
+	deadline time.Duration
+	auth     *auth.Keyring // nil unless relayed packets are authenticated
+
+	mu      sync.Mutex
+	conn    net.PacketConn
+	pending map[key]*pending
+}
+
+type key struct {
+	addr string
+	seq  uint64
+}
+
+type pending struct {
+	frame   []byte // unsigned
+	to      net.Addr
+	expires time.Time
+	backoff time.Duration
+	timer   *time.Timer
+}
+
+// WriteTo sends msg to addr in a data frame which will be retransmitted until
+// it's either acknowledged or its deadline passes.
+//
+// WriteTo implements peer.Writer for Sender.
+func (s *Sender) WriteTo(msg []byte, addr net.Addr) (n int, err error) {
+	h := Header{
+		Sender: s.id,
+		Seq:    s.seq.Inc(),
+	}
+	k := key{addr.String(), h.Seq}
+
+	p := &pending{
+		frame:   encode(typeData, h, msg),
+		to:      addr,
+		expires: time.Now().Add(s.deadline),
+		backoff: minBackoff,
+	}
+
+	s.mu.Lock()
+	conn := s.conn
+	if conn == nil {
+		s.mu.Unlock()
+
+		return 0, errNotBound
+	}
+
+	s.pending[k] = p
+	p.timer = time.AfterFunc(p.backoff, func() { s.retransmit(k) })
+	s.mu.Unlock()
+
+	sent.Inc()
+
+	if n, err = conn.WriteTo(s.sign(p.frame), addr); n >= len(p.frame) {
+		n = len(msg)
+	}
+
+	return
+}
+
+func (s *Sender) retransmit(k key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.pending[k]
+	switch {
+	case p == nil:
+		return // acknowledged
+	case s.conn == nil, !time.Now().Before(p.expires):
+		delete(s.pending, k)
+
+		s.logger.Warn("lost frame.",
+			zap.String("addr", k.addr),
+			zap.Uint64("seq", k.seq))
+
+		lost.Inc()
+
+		return
+	}
+
+	// retransmissions are signed anew, since the receiving side drops
+	// replayed tags
+	if _, err := s.conn.WriteTo(s.sign(p.frame), p.to); err != nil {
+		s.logger.Debug("failed retransmitting.",
+			zap.String("addr", k.addr),
+			zap.Uint64("seq", k.seq),
+			zap.Error(err))
+	}
+	retransmitted.Inc()
+
+	if p.backoff <<= 1; p.backoff > maxBackoff {
+		p.backoff = maxBackoff
+	}
+	if rem := time.Until(p.expires); p.backoff > rem {
+		p.backoff = rem
+	}
+	p.timer.Reset(p.backoff)
+}
+
+// sign returns frame, signed in case s authenticates.
+func (s *Sender) sign(frame []byte) []byte {
+	return s.auth.Sign(auth.TypeRelay, frame)
+}
+
+func (s *Sender) ack(addr net.Addr, seq uint64) {
+	k := key{addr.String(), seq}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p := s.pending[k]; p != nil {
+		p.timer.Stop()
+		delete(s.pending, k)
+
+		acknowledged.Inc()
+	}
+}
+
+func (s *Sender) setConn(conn net.PacketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn = conn
+}
+
+// abandon stops retransmitting all pending frames.
+func (s *Sender) abandon() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, p := range s.pending {
+		p.timer.Stop()
+		delete(s.pending, k)
+	}
+}
+
+func (s *Sender) run(ctx context.Context, conn net.PacketConn) {
+	exited := make(chan struct{})
+	defer close(exited)
+
+	closer := common.CloseOnce(conn)
+	defer closer.Close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		select {
+		case <-ctx.Done():
+			_ = closer.Close()
+		case <-exited:
+			break
+		}
+	}()
+
+	buf := buffer.Get()
+	defer buffer.Put(buf)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf[:])
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Warn("failed reading.",
+					zap.Error(err))
+			}
+
+			return
+		}
+
+		frame, ok := s.auth.Verify(auth.TypeReply, buf[:n])
+		if !ok {
+			s.logger.Debug("dropped unauthenticated acknowledgement.",
+				log.Addr(addr))
+
+			continue
+		}
+
+		if typ, h, _, ok := parse(frame); ok && typ == typeAck && h.Sender == s.id {
+			s.ack(addr, h.Seq)
+		}
+	}
+}
+
+func bind(logger *zap.Logger) net.PacketConn {
+	logger.Info("binding ...")
+
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		logger.Warn("failed binding.",
+			zap.Error(err))
+
+		return nil
+	}
+	logger.Debug("bound.",
+		log.Addr(conn.LocalAddr()))
+
+	return conn
+}
+
+func randomID() uint64 {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+
+	return binary.BigEndian.Uint64(id[:])
+}
@@ -0,0 +1,105 @@
+package seal
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	var (
+		payload = []byte("payload")
+		keys    = map[uint8][]byte{
+			1: bytes.Repeat([]byte{1}, 16),
+			2: bytes.Repeat([]byte{2}, 32),
+		}
+	)
+
+	newSealer := func(t *testing.T, keys map[uint8][]byte, key uint8) *Sealer {
+		t.Helper()
+
+		s, err := New(keys, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	cases := []struct {
+		name     string
+		sealed   func(t *testing.T) []byte
+		expected bool
+	}{
+		{
+			name:     "sealed with the signing key",
+			sealed:   func(t *testing.T) []byte { return newSealer(t, keys, 1).Seal(payload) },
+			expected: true,
+		},
+		{
+			name:     "sealed with another known key",
+			sealed:   func(t *testing.T) []byte { return newSealer(t, keys, 2).Seal(payload) },
+			expected: true,
+		},
+		{
+			name: "sealed with an unknown key",
+			sealed: func(t *testing.T) []byte {
+				return newSealer(t, map[uint8][]byte{3: keys[1]}, 3).Seal(payload)
+			},
+		},
+		{
+			name: "sealed with another key of the same ID",
+			sealed: func(t *testing.T) []byte {
+				return newSealer(t, map[uint8][]byte{1: keys[2]}, 1).Seal(payload)
+			},
+		},
+		{
+			name: "tampered ciphertext",
+			sealed: func(t *testing.T) []byte {
+				b := newSealer(t, keys, 1).Seal(payload)
+				b[HeaderSize] ^= 1
+
+				return b
+			},
+		},
+		{
+			name: "tampered nonce",
+			sealed: func(t *testing.T) []byte {
+				b := newSealer(t, keys, 1).Seal(payload)
+				b[5] ^= 1
+
+				return b
+			},
+		},
+		{
+			name: "truncated",
+			sealed: func(t *testing.T) []byte {
+				b := newSealer(t, keys, 1).Seal(payload)
+
+				return b[:len(b)-1]
+			},
+		},
+		{
+			name:   "unsealed",
+			sealed: func(*testing.T) []byte { return payload },
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := newSealer(t, keys, 1).Open(c.sealed(t))
+			if ok != c.expected {
+				t.Fatalf("expected %t, got %t", c.expected, ok)
+			}
+			if ok && !bytes.Equal(got, payload) {
+				t.Errorf("expected %q, got %q", payload, got)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(map[uint8][]byte{1: []byte("short")}, 1); err == nil {
+		t.Error("accepted a key of invalid size")
+	}
+}
@@ -0,0 +1,48 @@
+package wire
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchSize denotes the maximum number of packets read per call.
+const batchSize = 1 << 5
+
+// batchConn wraps a UDP connection so that it may read and write in batches
+// (via recvmmsg and sendmmsg, where available).
+//
+// batchConn implements peer.BatchWriter.
+type batchConn struct {
+	*net.UDPConn
+
+	pc interface {
+		ReadBatch(ms []ipv4.Message, flags int) (int, error)
+		WriteBatch(ms []ipv4.Message, flags int) (int, error)
+	}
+}
+
+func newBatchConn(conn *net.UDPConn) *batchConn {
+	bc := &batchConn{
+		UDPConn: conn,
+	}
+
+	if addr, _ := conn.LocalAddr().(*net.UDPAddr); addr != nil && addr.IP.To4() != nil {
+		bc.pc = ipv4.NewPacketConn(conn)
+	} else {
+		bc.pc = ipv6.NewPacketConn(conn)
+	}
+
+	return bc
+}
+
+// ReadBatch reads a batch of packets into ms.
+func (bc *batchConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return bc.pc.ReadBatch(ms, flags)
+}
+
+// WriteBatch writes the batch of packets ms holds.
+func (bc *batchConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	return bc.pc.WriteBatch(ms, flags)
+}
@@ -0,0 +1,107 @@
+package wire
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+)
+
+// flood binds a loopback UDP connection and sends packets of the given size to
+// it, in batches, until the benchmark ends.
+func flood(b *testing.B, size int) *net.UDPConn {
+	b.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	out, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	b.Cleanup(func() {
+		close(done)
+		wg.Wait()
+
+		_ = conn.Close()
+		_ = out.Close()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		var (
+			bc = newBatchConn(out)
+			ms = make([]ipv4.Message, batchSize)
+		)
+		for i := range ms {
+			ms[i] = ipv4.Message{
+				Buffers: [][]byte{make([]byte, size)},
+				Addr:    conn.LocalAddr(),
+			}
+		}
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_, _ = bc.WriteBatch(ms, 0)
+			}
+		}
+	}()
+
+	return conn
+}
+
+// BenchmarkRead compares reading packets in batches, via recvmmsg, against
+// reading them one by one.
+func BenchmarkRead(b *testing.B) {
+	const size = 512 // of each packet
+
+	b.Run("batched", func(b *testing.B) {
+		var (
+			bc = newBatchConn(flood(b, size))
+			ms = make([]ipv4.Message, batchSize)
+		)
+		for i := range ms {
+			ms[i].Buffers = [][]byte{make([]byte, 1<<16)}
+		}
+
+		b.SetBytes(size)
+		b.ResetTimer()
+
+		for read := 0; read < b.N; {
+			n, err := bc.ReadBatch(ms, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			read += n
+		}
+	})
+
+	b.Run("single", func(b *testing.B) {
+		var (
+			conn = flood(b, size)
+			buf  = make([]byte, 1<<16)
+		)
+
+		b.SetBytes(size)
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,9 @@
+package wire
+
+import "syscall"
+
+// isTruncated reports whether the datagram which was read into a buffer of the
+// given size was truncated, based on the MSG_TRUNC flag recvmsg reports.
+func isTruncated(_, flags, _ int) bool {
+	return flags&syscall.MSG_TRUNC != 0
+}
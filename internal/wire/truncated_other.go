@@ -0,0 +1,12 @@
+//go:build !linux
+
+package wire
+
+// isTruncated reports whether the datagram which was read into a buffer of the
+// given size was truncated.
+//
+// Lacking a reliable indication, datagrams which fill the buffer are presumed
+// truncated.
+func isTruncated(n, _, size int) bool {
+	return n >= size
+}
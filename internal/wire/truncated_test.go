@@ -0,0 +1,95 @@
+package wire
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
+
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/metrics"
+)
+
+func TestTruncated(t *testing.T) {
+	const maxSize = 16
+
+	var (
+		small     = []byte("small")
+		oversized = bytes.Repeat([]byte{'x'}, maxSize<<1)
+		last      = []byte("last")
+	)
+
+	cases := []struct {
+		policy   string
+		expected [][]byte
+	}{
+		{
+			policy:   config.TruncatedDrop,
+			expected: [][]byte{small, last},
+		},
+		{
+			policy: config.TruncatedMark,
+			expected: [][]byte{
+				small,
+				append(truncatedMarker[:], oversized[:maxSize]...),
+				last,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.policy, func(t *testing.T) {
+			var (
+				conn   = listenLoopback(t)
+				client = listenLoopback(t)
+				ms     = make([]ipv4.Message, batchSize)
+			)
+			for i := range ms {
+				ms[i].Buffers = [][]byte{make([]byte, maxSize)}
+			}
+
+			b := &broadcaster{
+				logger:    zap.NewNop(),
+				conn:      newBatchConn(conn),
+				ms:        ms,
+				truncated: c.policy,
+
+				packets:    metrics.PacketsReceived.WithLabelValues("test"),
+				bytes:      metrics.BytesReceived.WithLabelValues("test"),
+				truncation: metrics.Truncated.WithLabelValues("test", c.policy),
+				sampled:    zap.NewNop(),
+			}
+
+			for _, pkt := range [][]byte{small, oversized, last} {
+				if _, err := client.WriteTo(pkt, conn.LocalAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got [][]byte
+			for reads := 0; reads < 3 && len(got) < len(c.expected); reads++ {
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+				msgs, err := b.read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, msg := range msgs {
+					got = append(got, append([]byte(nil), msg...))
+				}
+			}
+
+			if len(got) != len(c.expected) {
+				t.Fatalf("expected %d messages, got %q", len(c.expected), got)
+			}
+			for i, msg := range c.expected {
+				if !bytes.Equal(got[i], msg) {
+					t.Errorf("%d: expected %q, got %q", i, msg, got[i])
+				}
+			}
+		})
+	}
+}
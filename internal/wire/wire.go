@@ -4,90 +4,205 @@ package wire
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/azazeal/health"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/ipv4"
 
+	"github.com/azazeal/flycast/internal/acl"
+	"github.com/azazeal/flycast/internal/auth"
 	"github.com/azazeal/flycast/internal/buffer"
+	"github.com/azazeal/flycast/internal/common"
 	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/egress"
 	"github.com/azazeal/flycast/internal/log"
 	"github.com/azazeal/flycast/internal/loop"
+	"github.com/azazeal/flycast/internal/metrics"
 	"github.com/azazeal/flycast/internal/peer"
-	"github.com/azazeal/flycast/internal/region"
+	"github.com/azazeal/flycast/internal/ratelimit"
 )
 
-// Broadcast starts broadcasting to pl UDP messages it accepts on the UDP port
-// for as long as ctx is not done.
+// Broadcast starts broadcasting to pl UDP messages it accepts on the port of
+// the given channel for as long as ctx is not done.
 //
 // When ctx is done and the broadcasting has stopped, Done will be called on wg.
-func Broadcast(ctx context.Context, wg *sync.WaitGroup, pl *peer.List, global bool) {
+func Broadcast(ctx context.Context, wg *sync.WaitGroup, pl *peer.List, ch *config.Channel) {
 	var (
 		logger = log.FromContext(ctx).
 			Named("wire").
-			Named(region.Alias(global))
-		cfg = config.FromContext(ctx)
+			Named(ch.Name)
 		hc  = health.FromContext(ctx)
-		hcc = region.WireComponent(global)
+		hcc = common.ChannelComponent(common.HCWire, ch.Name)
+		out = egress.New(ctx, ch)
+		kr  *auth.Keyring
+
+		port      = ch.Port
+		host      = ch.Bind
+		truncated = ch.Truncated
 	)
 
+	if config.FromContext(ctx).Auth.Ingress {
+		kr = auth.FromContext(ctx)
+	}
+
+	wg.Add(1)
+	rules := acl.FromContext(ctx).Rules(ctx, wg, logger, port, &ch.ACL)
+	limiter := ratelimit.FromContext(ctx).Limiter(ch.Name, port, ch.Rate)
+
 	go func() {
 		defer wg.Done()
 
 		loop.Func(ctx, time.Second, func(ctx context.Context) {
 			defer hc.Fail(hcc)
 
-			conn := bind(logger, bindPort(cfg, global))
+			conn := bind(logger, host, port)
 			if conn == nil {
 				return
 			}
+
+			// the address a port is bound to may not reach the peers (i.e.
+			// fly-global-services is an IPv4 one while 6PN addresses are
+			// IPv6), so packets are sent from all addresses instead
+			sender := conn
+			if host != config.BindWildcard {
+				if sender = bindSender(logger, port); sender == nil {
+					_ = conn.Close()
+
+					return
+				}
+			}
 			hc.Pass(hcc)
 
-			buf := buffer.Get()
-			defer buffer.Put(buf)
+			ms := make([]ipv4.Message, batchSize)
+			for i := range ms {
+				buf := buffer.Get()
+				defer buffer.Put(buf)
+
+				// datagrams which exceed the maximum size are truncated,
+				// which isTruncated detects
+				ms[i].Buffers = [][]byte{buf[:ch.MaxSize]}
+			}
 
 			run(ctx, &broadcaster{
 				logger: logger,
-				conn:   conn,
+				conn:   newBatchConn(conn),
+				sender: newBatchConn(sender),
 				pl:     pl,
-				buf:    buf,
+				out:    out,
+				auth:   kr,
+				rules:  rules,
+				limit:  limiter,
+				ms:     ms,
+				msgs:   make([][]byte, 0, batchSize),
+
+				truncated: truncated,
+
+				packets:    metrics.PacketsReceived.WithLabelValues(metrics.Port(port)),
+				bytes:      metrics.BytesReceived.WithLabelValues(metrics.Port(port)),
+				truncation: metrics.Truncated.WithLabelValues(metrics.Port(port), truncated),
+				denied:     metrics.Rejected.WithLabelValues(metrics.Port(port), acl.RuleDeny),
+				disallowed: metrics.Rejected.WithLabelValues(metrics.Port(port), acl.RuleAllow),
+				sampled:    sampled(logger),
 			})
 		})
 	}()
 }
 
-func bind(logger *zap.Logger, port int) net.PacketConn {
-	logger = logger.With(log.Port(port))
+// bind binds the given port of the given host, which may be
+// config.BindWildcard or a name, such as config.BindFlyGlobalServices, to be
+// resolved.
+func bind(logger *zap.Logger, host string, port int) *net.UDPConn {
+	logger = logger.With(log.Port(port), zap.String("host", host))
 	logger.Info("binding ...")
 
-	l, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if host == config.BindWildcard {
+		host = ""
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		logger.Warn("failed resolving bind address.",
+			zap.Error(err))
+
+		metrics.BindRetries.WithLabelValues(metrics.Port(port)).Inc()
+
+		return nil
+	}
+
+	l, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		logger.Warn("failed binding.",
 			zap.Error(err))
 
+		metrics.BindRetries.WithLabelValues(metrics.Port(port)).Inc()
+
 		return nil
 	}
-	logger.Debug("bound.")
+	logger.Debug("bound.",
+		log.Addr(l.LocalAddr()))
 
 	return l
 }
 
-func bindPort(cfg *config.Config, global bool) int {
-	if global {
-		return cfg.Ports.Global
+// bindSender binds an ephemeral port of all of the local addresses, which the
+// packets arriving on the given port are sent to the peers from.
+func bindSender(logger *zap.Logger, port int) *net.UDPConn {
+	logger = logger.With(log.Port(port))
+	logger.Info("binding sender ...")
+
+	l, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logger.Warn("failed binding sender.",
+			zap.Error(err))
+
+		metrics.BindRetries.WithLabelValues(metrics.Port(port)).Inc()
+
+		return nil
 	}
+	logger.Debug("bound sender.",
+		log.Addr(l.LocalAddr()))
 
-	return cfg.Ports.Local
+	return l
 }
 
 type broadcaster struct {
 	logger *zap.Logger
-	conn   net.PacketConn
+	conn   *batchConn
+	sender *batchConn // conn, unless conn is bound to a specific address
 	pl     *peer.List
-	buf    *buffer.Buffer
+	out    *egress.Pipeline
+	auth   *auth.Keyring      // nil unless ingress packets are authenticated
+	rules  *acl.Rules         // nil unless sources are restricted
+	limit  *ratelimit.Limiter // nil unless rates are limited
+	ms     []ipv4.Message     // the batch packets are read into
+	msgs   [][]byte           // the messages of the last batch read
+
+	// truncated holds the policy for truncated packets
+	truncated string
+
+	packets    prometheus.Counter
+	bytes      prometheus.Counter
+	truncation prometheus.Counter
+	denied     prometheus.Counter
+	disallowed prometheus.Counter
+
+	// sampled logs the packets rejected due to their source or throttled,
+	// sparingly
+	sampled *zap.Logger
+}
+
+// sampled returns a copy of logger which logs each message at most once per
+// second.
+func sampled(logger *zap.Logger) *zap.Logger {
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewSamplerWithOptions(core, time.Second, 1, 0)
+	}))
 }
 
 func run(ctx context.Context, b *broadcaster) {
@@ -114,21 +229,31 @@ func run(ctx context.Context, b *broadcaster) {
 	}()
 
 	for {
-		msg, err := b.read()
+		msgs, err := b.read()
 		if err != nil && !isTimeout(err) {
 			return // terminal error
 		}
-		if len(msg) == 0 {
+		if len(msgs) == 0 {
 			continue // nothing read
 		}
 
-		b.pl.Broadcast(b.conn, msg)
+		if _, _, filtered := b.out.Broadcast(b.pl, b.sender, msgs...); filtered > 0 {
+			b.logger.Debug("dropped looping or duplicate packets.",
+				zap.Int("dropped", filtered))
+		}
 	}
 }
 
 func shutdown(b *broadcaster) {
 	b.logger.Info("shutting down ...")
 
+	if b.sender != b.conn {
+		if err := b.sender.Close(); err != nil {
+			b.logger.Warn("failed closing sender.",
+				zap.Error(err))
+		}
+	}
+
 	if err := b.conn.Close(); err != nil {
 		b.logger.Warn("failed shutting down.",
 			zap.Error(err))
@@ -139,27 +264,122 @@ func shutdown(b *broadcaster) {
 	b.logger.Debug("shut down.")
 }
 
-func (b *broadcaster) read() ([]byte, error) {
-	logger := b.logger
+// read reads a batch of packets and returns the messages they carry.
+func (b *broadcaster) read() ([][]byte, error) {
+	n, err := b.conn.ReadBatch(b.ms, 0)
+	if err != nil {
+		b.logger.Error("failed reading.",
+			zap.Error(err))
 
-	n, addr, err := b.conn.ReadFrom(b.buf[:buffer.Size:buffer.Size])
-	if n > 0 {
-		logger = logger.With(log.Data(b.buf[:n]))
+		return nil, err
 	}
-	if addr != nil {
-		logger = logger.With(log.Addr(addr))
+
+	b.msgs = b.msgs[:0]
+	for i := range b.ms[:n] {
+		if msg := b.accept(&b.ms[i]); len(msg) > 0 {
+			b.msgs = append(b.msgs, msg)
+		}
 	}
 
-	if err != nil {
-		logger.Error("failed reading.",
-			zap.Error(err))
+	return b.msgs, nil
+}
 
-		return nil, err
+// accept returns the message m carries, after applying the source rules and
+// rate limits, verifying and stripping its tag and applying the truncation
+// policy.
+func (b *broadcaster) accept(m *ipv4.Message) []byte {
+	buf := m.Buffers[0]
+	msg := buf[:m.N]
+
+	if !b.admit(m) {
+		return nil
 	}
 
+	logger := b.logger.With(log.Data(msg))
+	if m.Addr != nil {
+		logger = logger.With(log.Addr(m.Addr))
+	}
 	logger.Info("read.")
 
-	return b.buf[:n], err
+	b.packets.Inc()
+	b.bytes.Add(float64(m.N))
+
+	if b.auth != nil {
+		// truncated packets fail verification, since the MAC covers all of
+		// the payload
+		payload, ok := b.auth.Verify(auth.TypeIngress, msg)
+		if !ok {
+			logger.Debug("dropped unauthenticated packet.")
+		}
+
+		return payload
+	}
+
+	if isTruncated(m.N, m.Flags, len(buf)) {
+		return b.truncate(logger, msg)
+	}
+
+	return msg
+}
+
+// admit reports whether the source rules and rate limits of b admit m.
+func (b *broadcaster) admit(m *ipv4.Message) bool {
+	if b.rules == nil && b.limit == nil {
+		return true
+	}
+
+	var ip net.IP
+	if addr, ok := m.Addr.(*net.UDPAddr); ok {
+		ip = addr.IP
+	}
+
+	if ok, rule := b.rules.Admit(ip); !ok {
+		b.packets.Inc()
+		b.bytes.Add(float64(m.N))
+		if rule == acl.RuleDeny {
+			b.denied.Inc()
+		} else {
+			b.disallowed.Inc()
+		}
+
+		b.sampled.Warn("rejected packet.",
+			log.IP(ip),
+			zap.String("rule", rule))
+
+		return false
+	}
+
+	if ok, limit := b.limit.Admit(ip, m.N); !ok {
+		b.packets.Inc()
+		b.bytes.Add(float64(m.N))
+
+		b.sampled.Warn("throttled packet.",
+			log.IP(ip),
+			zap.String("limit", limit))
+
+		return false
+	}
+
+	return true
+}
+
+// truncatedMarker is the wire prefix of the truncated packets which are
+// relayed.
+var truncatedMarker = [...]byte{'f', 'c', 't', 1}
+
+// truncate applies the truncation policy of b to the given truncated message.
+func (b *broadcaster) truncate(logger *zap.Logger, msg []byte) []byte {
+	b.truncation.Inc()
+
+	if b.truncated == config.TruncatedDrop {
+		logger.Warn("dropped truncated packet.")
+
+		return nil
+	}
+
+	logger.Warn("marked truncated packet.")
+
+	return append(truncatedMarker[:], msg...)
 }
 
 func isTimeout(err error) bool {
@@ -0,0 +1,299 @@
+package wire
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azazeal/health"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+	"golang.org/x/net/ipv4"
+
+	"github.com/azazeal/flycast/internal/buffer"
+	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/discovery"
+	"github.com/azazeal/flycast/internal/egress"
+	"github.com/azazeal/flycast/internal/log"
+	"github.com/azazeal/flycast/internal/metrics"
+	"github.com/azazeal/flycast/internal/peer"
+)
+
+// The parameters of BenchmarkBroadcast.
+const (
+	benchPeers  = 8   // the number of peers packets are broadcast to
+	benchSize   = 512 // the size of each packet
+	benchWindow = 256 // the maximum number of packets in flight
+
+	// benchStall denotes the duration after which the packets in flight are
+	// considered lost.
+	benchStall = 100 * time.Millisecond
+)
+
+func listenLoopback(tb testing.TB) *net.UDPConn {
+	tb.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	_ = conn.SetReadBuffer(1 << 22)
+	tb.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+// startPeers starts n loopback peers, which count the frames they receive into
+// received until the benchmark ends, and returns their instances.
+func startPeers(b *testing.B, n int, received *atomic.Int64) []discovery.Instance {
+	b.Helper()
+
+	insts := make([]discovery.Instance, 0, n)
+	for i := 0; i < n; i++ {
+		bc := newBatchConn(listenLoopback(b))
+
+		ms := make([]ipv4.Message, batchSize)
+		for i := range ms {
+			ms[i].Buffers = [][]byte{make([]byte, buffer.Size)}
+		}
+
+		go func() {
+			for {
+				n, err := bc.ReadBatch(ms, 0)
+				if err != nil {
+					return
+				}
+				received.Add(int64(n))
+			}
+		}()
+
+		addr := bc.LocalAddr().(*net.UDPAddr)
+		insts = append(insts, discovery.Instance{
+			IP:     addr.IP,
+			Port:   addr.Port,
+			Region: "ord",
+		})
+	}
+
+	return insts
+}
+
+// drive sends b.N packets to the given address, keeping at most benchWindow of
+// them in flight, and waits for the peers to receive them. It reports the
+// frames the peers received per second, along with the ratio of those lost.
+func drive(b *testing.B, to *net.UDPAddr, peers int, received *atomic.Int64) {
+	b.Helper()
+
+	client := newBatchConn(listenLoopback(b))
+
+	ms := make([]ipv4.Message, batchSize)
+	for i := range ms {
+		ms[i] = ipv4.Message{
+			Buffers: [][]byte{make([]byte, benchSize)},
+			Addr:    to,
+		}
+	}
+
+	var (
+		sent int64 // packets
+		lost int64 // frames
+
+		progress = time.Now()
+		last     = received.Load()
+	)
+	// wait waits for fewer than max packets to remain in flight, or for those
+	// in flight to stall, in which case they are considered lost.
+	wait := func(max int64) {
+		for {
+			got := received.Load()
+			if sent*int64(peers)-got-lost < max*int64(peers) {
+				return
+			}
+
+			switch now := time.Now(); {
+			case got != last:
+				last, progress = got, now
+			case now.Sub(progress) > benchStall:
+				lost = sent*int64(peers) - got
+				progress = now
+
+				return
+			}
+			time.Sleep(10 * time.Microsecond)
+		}
+	}
+
+	b.SetBytes(benchSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+
+	for sent < int64(b.N) {
+		wait(benchWindow - batchSize + 1)
+
+		n := int64(batchSize)
+		if rem := int64(b.N) - sent; rem < n {
+			n = rem
+		}
+
+		w, err := client.WriteBatch(ms[:n], 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sent += int64(w)
+	}
+	wait(1)
+
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	b.ReportMetric(float64(received.Load())/elapsed.Seconds(), "frames/s")
+	b.ReportMetric(float64(lost)/float64(sent*int64(peers)), "lost")
+}
+
+// BenchmarkBroadcast compares, end to end, broadcasting the packets read in
+// batches via the egress pipeline and the senders of the peer list against
+// reading them one by one and sending each to every peer from a goroutine of
+// its own, as the broadcaster did before batching.
+func BenchmarkBroadcast(b *testing.B) {
+	b.Run("batched", func(b *testing.B) {
+		var received atomic.Int64
+
+		var (
+			insts = startPeers(b, benchPeers, &received)
+			ch    = &config.Channel{
+				Name:      "bench",
+				Mode:      config.ModeBroadcast,
+				Truncated: config.TruncatedDrop,
+			}
+			cfg = &config.Config{
+				Region: "ord",
+			}
+		)
+		cfg.Discovery.Backend = discovery.BackendStatic
+		cfg.Discovery.Peers = insts
+		cfg.Refresh.Interval = time.Minute
+		cfg.Refresh.Max = time.Minute
+		cfg.Stale.Max = time.Hour
+		cfg.Stale.Policy = config.StaleKeep
+
+		ctx, cancel := context.WithCancel(context.Background())
+		ctx = log.NewContext(ctx, zap.NewNop())
+		ctx = config.NewContext(ctx, cfg)
+		ctx = health.NewContext(ctx, new(health.Check))
+
+		var wg sync.WaitGroup
+		b.Cleanup(func() {
+			cancel()
+			wg.Wait()
+		})
+
+		wg.Add(1)
+		pl := peer.Refresh(ctx, &wg, ch)
+		for {
+			if peers, _ := pl.Send(discard{}, peer.Packet{Frames: [][]byte{nil}}); peers == benchPeers {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		var (
+			conn = newBatchConn(listenLoopback(b))
+			ms   = make([]ipv4.Message, batchSize)
+		)
+		for i := range ms {
+			ms[i].Buffers = [][]byte{make([]byte, buffer.Size)}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			run(ctx, &broadcaster{
+				logger: zap.NewNop(),
+				conn:   conn,
+				sender: conn,
+				pl:     pl,
+				out:    egress.New(ctx, ch),
+				ms:     ms,
+				msgs:   make([][]byte, 0, batchSize),
+
+				truncated: ch.Truncated,
+
+				packets:    metrics.PacketsReceived.WithLabelValues("bench"),
+				bytes:      metrics.BytesReceived.WithLabelValues("bench"),
+				truncation: metrics.Truncated.WithLabelValues("bench", ch.Truncated),
+				sampled:    zap.NewNop(),
+			})
+		}()
+
+		drive(b, conn.LocalAddr().(*net.UDPAddr), benchPeers, &received)
+	})
+
+	b.Run("goroutine per peer", func(b *testing.B) {
+		var received atomic.Int64
+
+		var (
+			insts = startPeers(b, benchPeers, &received)
+			peers = make([]*net.UDPAddr, 0, len(insts))
+			conn  = listenLoopback(b)
+		)
+		for _, inst := range insts {
+			peers = append(peers, &net.UDPAddr{IP: inst.IP, Port: inst.Port})
+		}
+
+		go broadcastPerPeer(zap.NewNop(), conn, peers)
+
+		drive(b, conn.LocalAddr().(*net.UDPAddr), benchPeers, &received)
+	})
+}
+
+// discard is a peer.Writer which discards what it is asked to write.
+type discard struct{}
+
+func (discard) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return len(p), nil
+}
+
+// broadcastPerPeer reads packets from conn one by one and sends each of them
+// to every peer from a goroutine of its own, as the broadcaster and
+// peer.List.Broadcast did before batching, until conn is closed.
+func broadcastPerPeer(logger *zap.Logger, conn *net.UDPConn, peers []*net.UDPAddr) {
+	buf := make([]byte, buffer.Size)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		msg := buf[:n]
+
+		var wg sync.WaitGroup
+		wg.Add(len(peers))
+		for _, addr := range peers {
+			addr := addr
+
+			go func() {
+				defer wg.Done()
+
+				logger := logger.
+					With(log.IP(addr.IP)).
+					With(log.Port(addr.Port)).
+					With(log.Data(msg))
+				logger.Debug("sending ...")
+
+				if _, err := conn.WriteTo(msg, addr); err != nil {
+					logger.Warn("failed sending.",
+						zap.Error(err))
+
+					return
+				}
+
+				logger.Debug("done sending.")
+			}()
+		}
+		wg.Wait()
+	}
+}
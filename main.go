@@ -10,10 +10,18 @@ import (
 	"github.com/azazeal/exit"
 	"github.com/azazeal/health"
 
+	"github.com/azazeal/flycast/internal/acl"
 	"github.com/azazeal/flycast/internal/app"
+	"github.com/azazeal/flycast/internal/auth"
 	"github.com/azazeal/flycast/internal/config"
+	"github.com/azazeal/flycast/internal/envelope"
+	"github.com/azazeal/flycast/internal/latency"
 	"github.com/azazeal/flycast/internal/log"
 	"github.com/azazeal/flycast/internal/peer"
+	"github.com/azazeal/flycast/internal/ratelimit"
+	"github.com/azazeal/flycast/internal/relay"
+	"github.com/azazeal/flycast/internal/reliable"
+	"github.com/azazeal/flycast/internal/seal"
 	"github.com/azazeal/flycast/internal/wire"
 )
 
@@ -34,19 +42,42 @@ func run() (err error) {
 	var wg sync.WaitGroup
 	defer wg.Wait()
 
+	cfg := config.FromContext(ctx)
+
+	// start the reliable sender
+	if cfg.Reliable.Enabled {
+		wg.Add(1)
+		ctx = reliable.NewContext(ctx, reliable.Send(ctx, &wg))
+	}
+
+	// start probing the latency to other regions
+	if cfg.Latency.Probe {
+		wg.Add(1)
+		ctx = latency.NewProberContext(ctx, latency.Probe(ctx, &wg, latency.FromContext(ctx)))
+	}
+
+	// start delivering what's relayed to us
+	if len(cfg.Deliver) > 0 {
+		wg.Add(1)
+		relay.Receive(ctx, &wg)
+	}
+
+	// start refreshing the peer lists of the channels
+	lists := make([]*peer.List, 0, len(cfg.Channels))
+	for i := range cfg.Channels {
+		wg.Add(1)
+		lists = append(lists, peer.Refresh(ctx, &wg, &cfg.Channels[i]))
+	}
+
 	// start the http server
 	wg.Add(1)
-	app.Serve(ctx, &wg)
-
-	// start broadcasting globally
-	wg.Add(2)
-	global := peer.Refresh(ctx, &wg, true)
-	wire.Broadcast(ctx, &wg, global, true)
+	app.Serve(ctx, &wg, lists...)
 
-	// start broadcasting locally
-	wg.Add(2)
-	local := peer.Refresh(ctx, &wg, false)
-	wire.Broadcast(ctx, &wg, local, false)
+	// start broadcasting on each channel
+	for i, pl := range lists {
+		wg.Add(1)
+		wire.Broadcast(ctx, &wg, pl, &cfg.Channels[i])
+	}
 
 	return
 }
@@ -62,6 +93,31 @@ func newContext(parent context.Context) (ctx context.Context, err error) {
 	ctx = log.NewContext(parent, logger)
 	ctx = config.NewContext(ctx, cfg)
 	ctx = health.NewContext(ctx, new(health.Check))
+	ctx = latency.NewContext(ctx, latency.NewTable(cfg.Latency.Static))
+
+	if cfg.Auth.Ingress || cfg.Auth.Relay {
+		ctx = auth.NewContext(ctx, auth.NewKeyring(cfg.Auth.Keys, cfg.Auth.Key, cfg.Auth.Window))
+	}
+
+	if cfg.Encrypt.Enabled {
+		var s *seal.Sealer
+		if s, err = seal.New(cfg.Encrypt.Keys, cfg.Encrypt.Key); err != nil {
+			return
+		}
+		ctx = seal.NewContext(ctx, s)
+	}
+
+	// rates are limited per port; the ports which are not get no Limiter
+	ctx = ratelimit.NewContext(ctx, ratelimit.NewRegistry())
+
+	// so are sources restricted, by rules which a port and the broadcast
+	// requests of its channel share
+	ctx = acl.NewContext(ctx, acl.NewRegistry())
+
+	if cfg.Envelope.Enabled {
+		origin := envelope.Origin(cfg.Instance)
+		ctx = envelope.NewContext(ctx, envelope.NewFilter(origin, cfg.Envelope.Window))
+	}
 
 	logger.Info("running.", cfg.Fields()...)
 